@@ -4,11 +4,17 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
@@ -25,6 +31,8 @@ type Config struct {
 	RconHost          string
 	RconPort          string
 	RconPassword      string
+	HealthAddr        string
+	BackupSLA         time.Duration
 }
 
 func getConfig() *Config {
@@ -33,6 +41,12 @@ func getConfig() *Config {
 		fmt.Sscanf(days, "%d", &retentionDays)
 	}
 
+	sla, err := time.ParseDuration(getEnv("BACKUP_SLA", "24h"))
+	if err != nil {
+		slog.Warn("invalid BACKUP_SLA, using 24h", "err", err)
+		sla = 24 * time.Hour
+	}
+
 	return &Config{
 		ConnectionString:  os.Getenv("AZURE_STORAGE_CONNECTION_STRING"),
 		BackupContainer:   getEnv("BACKUP_CONTAINER", "minecraft-backups"),
@@ -42,6 +56,8 @@ func getConfig() *Config {
 		RconHost:          getEnv("RCON_HOST", "localhost"),
 		RconPort:          getEnv("RCON_PORT", "25575"),
 		RconPassword:      os.Getenv("RCON_PASSWORD"),
+		HealthAddr:        getEnv("HEALTH_ADDR", ""),
+		BackupSLA:         sla,
 	}
 }
 
@@ -52,6 +68,39 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// setupLogging installs a JSON (or, with LOG_FORMAT=text, plain text) slog handler at LOG_LEVEL
+// (debug, info, warn or error; default info). DEBUG=1 is shorthand for LOG_LEVEL=debug.
+func setupLogging() {
+	level := slog.LevelInfo
+	if getEnv("DEBUG", "0") == "1" {
+		level = slog.LevelDebug
+	}
+	if v := getEnv("LOG_LEVEL", ""); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			defer slog.Warn("invalid LOG_LEVEL, using info", "value", v)
+			level = slog.LevelInfo
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+		if a.Value.Kind() == slog.KindDuration {
+			a.Value = slog.StringValue(a.Value.Duration().String())
+		}
+		return a
+	}}
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if strings.EqualFold(getEnv("LOG_FORMAT", "json"), "text") {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h).With("service", "backup-manager"))
+}
+
+// newID returns a short random hex ID for correlating log lines.
+func newID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
 func sendRconCommand(config *Config, command string) error {
 	addr := fmt.Sprintf("%s:%s", config.RconHost, config.RconPort)
 	conn, err := rcon.Dial(addr, config.RconPassword)
@@ -68,21 +117,21 @@ func sendRconCommand(config *Config, command string) error {
 	return nil
 }
 
-func notifyPlayers(config *Config, message string) {
+func notifyPlayers(log *slog.Logger, config *Config, message string) {
 	cmd := fmt.Sprintf(`tellraw @a {"text":"%s","color":"yellow"}`, message)
 	if err := sendRconCommand(config, cmd); err != nil {
-		log.Printf("Failed to notify players: %v", err)
+		log.Warn("failed to notify players", "err", err)
 	}
 }
 
-func createBackup(config *Config, client *azblob.Client) error {
+func createBackup(log *slog.Logger, config *Config, client *azblob.Client) error {
 	timestamp := time.Now().UTC().Format("20060102_150405")
 	backupName := fmt.Sprintf("minecraft_backup_%s.tar.gz", timestamp)
 
-	log.Printf("Starting backup: %s", backupName)
+	log.Info("starting backup", "name", backupName)
 
 	// Notify players
-	notifyPlayers(config, "[Backup] Starting world backup in 10 seconds...")
+	notifyPlayers(log, config, "[Backup] Starting world backup in 10 seconds...")
 	time.Sleep(10 * time.Second)
 
 	// Disable auto-save
@@ -113,7 +162,7 @@ func createBackup(config *Config, client *azblob.Client) error {
 		folderPath := filepath.Join(config.MinecraftDataPath, folder)
 		if _, err := os.Stat(folderPath); err == nil {
 			if err := addToTar(tarWriter, folderPath, folder); err != nil {
-				log.Printf("Failed to add %s: %v", folder, err)
+				log.Warn("failed to add folder", "folder", folder, "err", err)
 			}
 		}
 	}
@@ -127,7 +176,7 @@ func createBackup(config *Config, client *azblob.Client) error {
 		filePath := filepath.Join(config.MinecraftDataPath, file)
 		if _, err := os.Stat(filePath); err == nil {
 			if err := addToTar(tarWriter, filePath, file); err != nil {
-				log.Printf("Failed to add %s: %v", file, err)
+				log.Warn("failed to add file", "file", file, "err", err)
 			}
 		}
 	}
@@ -151,8 +200,8 @@ func createBackup(config *Config, client *azblob.Client) error {
 	stat, _ := tmpFile.Stat()
 	sizeMB := float64(stat.Size()) / (1024 * 1024)
 
-	log.Printf("Backup completed: %s (%.2f MB)", backupName, sizeMB)
-	notifyPlayers(config, fmt.Sprintf("[Backup] World backup completed (%.2f MB)", sizeMB))
+	log.Info("backup completed", "name", backupName, "size_mb", sizeMB)
+	notifyPlayers(log, config, fmt.Sprintf("[Backup] World backup completed (%.2f MB)", sizeMB))
 
 	return nil
 }
@@ -193,7 +242,74 @@ func addToTar(tw *tar.Writer, path string, name string) error {
 	})
 }
 
-func cleanupOldBackups(config *Config, client *azblob.Client) error {
+// backupStatus remembers how the last backups went, for the health endpoints.
+var backupStatus struct {
+	sync.Mutex
+	started     time.Time
+	lastSuccess time.Time
+	lastAttempt time.Time
+	lastErr     error
+}
+
+// runBackup creates a backup under a fresh run ID and records the outcome.
+func runBackup(config *Config, client *azblob.Client) error {
+	log := slog.With("run", newID())
+	err := createBackup(log, config, client)
+	if err != nil {
+		log.Error("backup failed", "err", err)
+	}
+	backupStatus.Lock()
+	backupStatus.lastAttempt, backupStatus.lastErr = time.Now(), err
+	if err == nil {
+		backupStatus.lastSuccess = backupStatus.lastAttempt
+	}
+	backupStatus.Unlock()
+	return err
+}
+
+// serveHealth exposes /healthz and /readyz for container probes. /healthz only says the process is
+// up; /readyz also requires the last successful backup to be within BACKUP_SLA (counted from startup
+// until the first backup has run).
+func serveHealth(config *Config) {
+	if config.HealthAddr == "" {
+		return
+	}
+	report := func(w http.ResponseWriter, ready bool) {
+		backupStatus.Lock()
+		since := backupStatus.lastSuccess
+		if since.IsZero() {
+			since = backupStatus.started
+		}
+		withinSLA := time.Since(since) < config.BackupSLA
+		body := map[string]any{
+			"within_sla":   withinSLA,
+			"sla":          config.BackupSLA.String(),
+			"last_success": backupStatus.lastSuccess,
+			"last_attempt": backupStatus.lastAttempt,
+		}
+		if backupStatus.lastErr != nil {
+			body["error"] = backupStatus.lastErr.Error()
+		}
+		backupStatus.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if ready && !withinSLA {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(body)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) { report(w, false) })
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) { report(w, true) })
+	go func() {
+		slog.Info("health server listening", "addr", config.HealthAddr)
+		if err := http.ListenAndServe(config.HealthAddr, mux); err != nil {
+			slog.Error("health server failed", "err", err)
+		}
+	}()
+}
+
+func cleanupOldBackups(log *slog.Logger, config *Config, client *azblob.Client) error {
 	ctx := context.Background()
 	cutoff := time.Now().Add(-time.Duration(config.RetentionDays) * 24 * time.Hour)
 
@@ -207,10 +323,10 @@ func cleanupOldBackups(config *Config, client *azblob.Client) error {
 
 		for _, blob := range page.Segment.BlobItems {
 			if blob.Properties.LastModified.Before(cutoff) {
-				log.Printf("Deleting old backup: %s", *blob.Name)
+				log.Info("deleting old backup", "name", *blob.Name)
 				_, err := client.DeleteBlob(ctx, config.BackupContainer, *blob.Name, nil)
 				if err != nil {
-					log.Printf("Failed to delete %s: %v", *blob.Name, err)
+					log.Warn("failed to delete old backup", "name", *blob.Name, "err", err)
 				}
 			}
 		}
@@ -220,15 +336,18 @@ func cleanupOldBackups(config *Config, client *azblob.Client) error {
 }
 
 func main() {
+	setupLogging()
 	config := getConfig()
 
-	log.Printf("Minecraft Backup Manager started")
-	log.Printf("Schedule: %s, Retention: %d days", config.BackupSchedule, config.RetentionDays)
+	slog.Info("backup manager started", "schedule", config.BackupSchedule, "retention_days", config.RetentionDays)
+	backupStatus.started = time.Now()
+	serveHealth(config)
 
 	// Create Azure client
 	client, err := azblob.NewClientFromConnectionString(config.ConnectionString, nil)
 	if err != nil {
-		log.Fatalf("Failed to create Azure client: %v", err)
+		slog.Error("failed to create Azure client", "err", err)
+		os.Exit(1)
 	}
 
 	// Create container if needed
@@ -239,25 +358,26 @@ func main() {
 	c := cron.New()
 
 	_, err = c.AddFunc(config.BackupSchedule, func() {
-		if err := createBackup(config, client); err != nil {
-			log.Printf("Backup failed: %v", err)
-			notifyPlayers(config, "[Backup] Backup failed! Check server logs.")
+		if err := runBackup(config, client); err != nil {
+			notifyPlayers(slog.Default(), config, "[Backup] Backup failed! Check server logs.")
 		}
 	})
 	if err != nil {
-		log.Fatalf("Invalid cron schedule: %v", err)
+		slog.Error("invalid cron schedule", "err", err)
+		os.Exit(1)
 	}
 
 	// Schedule cleanup daily at 3 AM
 	c.AddFunc("0 3 * * *", func() {
-		if err := cleanupOldBackups(config, client); err != nil {
-			log.Printf("Cleanup failed: %v", err)
+		log := slog.With("run", newID())
+		if err := cleanupOldBackups(log, config, client); err != nil {
+			log.Error("cleanup failed", "err", err)
 		}
 	})
 
 	// Run initial backup after 5 minutes
 	time.AfterFunc(5*time.Minute, func() {
-		createBackup(config, client)
+		runBackup(config, client)
 	})
 
 	c.Start()
@@ -2,17 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/gorcon/rcon"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const azureScope = "https://management.azure.com/.default"
@@ -31,17 +41,32 @@ type Monitor struct {
 	containerAppName string
 	azureCredential  *azidentity.DefaultAzureCredential
 	lastStopTime     time.Time
+
+	// stopMu serialises stops triggered by inactivity and by the control endpoint
+	stopMu        sync.Mutex
+	shutdownGrace time.Duration
+	// shuttingDown is set while a requested shutdown runs; the proxy repeats its request until the
+	// server is down, and the repeats shouldn't start (and announce) another one
+	shuttingDown atomic.Bool
+
+	notify *notifier
+
+	// health of the check loop, for /healthz and /readyz
+	healthMu     sync.Mutex
+	started      time.Time
+	lastCheck    time.Time
+	lastCheckErr error
 }
 
 func main() {
-	log.SetPrefix("[player-monitor] ")
-	log.Println("Starting...")
-	log.Println("Waiting for server to start before monitoring...")
-	time.Sleep(1 * time.Minute)
+	setupLogging()
+	shutdownTracing := setupTracing(context.Background())
+	defer shutdownTracing(context.Background())
+	slog.Info("starting")
 
 	credential, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
-		log.Printf("Failed to create Azure credential (continuing without scaling): %v", err)
+		slog.Warn("failed to create Azure credential (continuing without scaling)", "err", err)
 	}
 
 	m := &Monitor{
@@ -56,41 +81,68 @@ func main() {
 		resourceGroup:    env("AZURE_RESOURCE_GROUP", ""),
 		containerAppName: env("AZURE_CONTAINER_APP_NAME", ""),
 		azureCredential:  credential,
+		shutdownGrace:    duration(env("SHUTDOWN_GRACE", "60s")),
+		started:          time.Now(),
+		notify:           newNotifier(),
 	}
 
 	if m.rconPassword == "" {
-		log.Fatal("RCON_PASSWORD required")
+		slog.Error("RCON_PASSWORD required")
+		os.Exit(1)
 	}
 
 	if m.checkInterval >= m.inactivityTimeout {
-		log.Fatal("CHECK_INTERVAL must be less than INACTIVITY_TIMEOUT")
+		slog.Error("CHECK_INTERVAL must be less than INACTIVITY_TIMEOUT")
+		os.Exit(1)
 	}
 
-	log.Printf("Config: %s, check=%v, timeout=%v, method=%s", m.rconAddr, m.checkInterval, m.inactivityTimeout, m.stopMethod)
-	m.run()
+	slog.Info("config", "rcon", m.rconAddr, "check", m.checkInterval, "timeout", m.inactivityTimeout, "method", m.stopMethod)
+	m.serveControl(env("CONTROL_ADDR", ""))
+	m.serveHealth(env("HEALTH_ADDR", ""))
+
+	// SIGTERM ends the check loop, so main returns and the last spans are flushed
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	slog.Info("waiting for server to start before monitoring")
+	select {
+	case <-time.After(1 * time.Minute):
+		m.run(ctx)
+	case <-ctx.Done():
+	}
+	slog.Info("exiting")
 }
 
-func (m *Monitor) run() {
+// run checks the server every checkInterval until ctx is done.
+func (m *Monitor) run(ctx context.Context) {
 	ticker := time.NewTicker(m.checkInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if err := m.check(); err != nil {
-			log.Printf("Check failed: %v", err)
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
 		}
+		// each check gets a run ID so the lines of one check, and any stop it triggers, can be grouped
+		ctx, span := startSpan(withLogger(context.Background(), slog.With("run", newID())), "check")
+		err := m.check(ctx)
+		if err != nil {
+			logger(ctx).Warn("check failed", "err", err)
+		}
+		endSpan(span, err)
+		m.healthMu.Lock()
+		m.lastCheck, m.lastCheckErr = time.Now(), err
+		m.healthMu.Unlock()
 	}
 }
 
 var playerCountRegex = regexp.MustCompile(`There are (\d+) of`)
 
-func (m *Monitor) check() error {
-	conn, err := rcon.Dial(m.rconAddr, m.rconPassword)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	resp, err := conn.Execute("list")
+func (m *Monitor) check(ctx context.Context) error {
+	log := logger(ctx)
+	_, rs := startSpan(ctx, "rcon.list")
+	resp, err := m.rconList()
+	endSpan(rs, err)
 	if err != nil {
 		return err
 	}
@@ -103,37 +155,61 @@ func (m *Monitor) check() error {
 
 	if playerCount > 0 {
 		m.lastPlayerTime = time.Now()
-		log.Printf("%d players online", playerCount)
+		log.Info("players online", "players", playerCount)
 		return nil
 	}
 
 	empty := time.Since(m.lastPlayerTime)
-	log.Printf("Empty for %v", empty)
+	log.Info("server empty", "for", empty)
 
 	if empty >= m.inactivityTimeout {
-		log.Printf("Stopping server after %v of inactivity", empty)
-		return m.stop()
+		log.Info("stopping server after inactivity", "for", empty)
+		err := m.stop(ctx, "Server stopping in 30s due to inactivity", 30*time.Second)
+		if err == nil && m.stopMethod != "noop" {
+			m.notify.send("sleep", "idle", roughDuration(empty))
+		}
+		return err
 	}
 
 	return nil
 }
 
-func (m *Monitor) stop() error {
+func (m *Monitor) rconList() (string, error) {
+	conn, err := rcon.Dial(m.rconAddr, m.rconPassword)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.Execute("list")
+}
+
+// stop shuts the server down using the configured method. warning is broadcast grace before an RCON
+// stop; the azure method skips it, since it only runs once nobody is online.
+func (m *Monitor) stop(ctx context.Context, warning string, grace time.Duration) (err error) {
+	m.stopMu.Lock()
+	defer m.stopMu.Unlock()
+	ctx, span := startSpan(ctx, "stop", attribute.String("stop.method", m.stopMethod))
+	defer func() { endSpan(span, err) }()
+	log := logger(ctx)
+
 	switch m.stopMethod {
 	case "azure":
-		return m.stopContainerApp()
+		return m.stopContainerApp(ctx)
 	case "rcon":
-		return m.stopViaRcon()
+		return m.stopViaRcon(ctx, warning, grace)
 	case "noop":
-		log.Println("Stop method is noop, doing nothing")
+		log.Info("stop method is noop, doing nothing")
 		return nil
 	default:
-		log.Printf("Unknown stop method: %s", m.stopMethod)
-		return m.stopViaRcon()
+		log.Warn("unknown stop method, using rcon", "method", m.stopMethod)
+		return m.stopViaRcon(ctx, warning, grace)
 	}
 }
 
-func (m *Monitor) stopViaRcon() error {
+func (m *Monitor) stopViaRcon(ctx context.Context, warning string, grace time.Duration) (err error) {
+	log := logger(ctx)
+	_, span := startSpan(ctx, "rcon.stop")
+	defer func() { endSpan(span, err) }()
 	conn, err := rcon.Dial(m.rconAddr, m.rconPassword)
 	if err != nil {
 		return err
@@ -141,21 +217,22 @@ func (m *Monitor) stopViaRcon() error {
 	defer conn.Close()
 
 	// Warn and stop
-	if _, err := conn.Execute("say Server stopping in 30s due to inactivity"); err != nil {
-		log.Printf("Warning message failed: %v", err)
+	if _, err := conn.Execute("say " + warning); err != nil {
+		log.Warn("warning message failed", "err", err)
 	}
-	time.Sleep(30 * time.Second)
+	time.Sleep(grace)
 
 	_, err = conn.Execute("stop")
 	if err != nil {
 		return err
 	}
 
-	log.Println("Stop command sent")
+	log.Info("stop command sent")
 	return nil
 }
 
-func (m *Monitor) stopContainerApp() error {
+func (m *Monitor) stopContainerApp(ctx context.Context) error {
+	log := logger(ctx)
 	// Cooldown check
 	const cooldown = 2 * time.Minute
 	if time.Since(m.lastStopTime) < cooldown {
@@ -177,10 +254,11 @@ func (m *Monitor) stopContainerApp() error {
 	}
 
 	// Get token
-	ctx := context.Background()
+	_, ts := startSpan(ctx, "azure.token")
 	token, err := m.azureCredential.GetToken(ctx, policy.TokenRequestOptions{
 		Scopes: []string{azureScope},
 	})
+	endSpan(ts, err)
 	if err != nil {
 		return fmt.Errorf("failed to get token: %v", err)
 	}
@@ -194,20 +272,24 @@ func (m *Monitor) stopContainerApp() error {
 			time.Sleep(time.Duration(1<<(attempt-1)) * time.Second)
 		}
 
-		req, err := http.NewRequest("POST", url, nil)
+		req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
 		if err != nil {
 			return err
 		}
 		req.Header.Set("Authorization", "Bearer "+token.Token)
 
+		_, as := startSpan(ctx, "arm.stop", attribute.Int("attempt", attempt+1))
 		resp, err := (&http.Client{}).Do(req)
 		if err != nil {
+			endSpan(as, err)
 			continue
 		}
 		defer resp.Body.Close()
+		as.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		as.End()
 
 		if resp.StatusCode >= 200 && resp.StatusCode < 300 || resp.StatusCode == 409 {
-			log.Println("✅ Container app stopped")
+			log.Info("container app stopped")
 			m.lastStopTime = time.Now()
 			return nil
 		}
@@ -220,6 +302,181 @@ func (m *Monitor) stopContainerApp() error {
 	return fmt.Errorf("stop failed")
 }
 
+// serveControl exposes POST /shutdown so the proxy can ask for a graceful stop, e.g. when quiet hours
+// begin. Requests must carry CONTROL_TOKEN as a bearer token; without one configured, every request is
+// refused.
+func (m *Monitor) serveControl(addr string) {
+	if addr == "" {
+		return
+	}
+	token := env("CONTROL_TOKEN", "")
+	if token == "" {
+		slog.Warn("CONTROL_ADDR set without CONTROL_TOKEN; shutdown requests will be refused")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /shutdown", func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "CONTROL_TOKEN not configured", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Reason == "" {
+			body.Reason = "requested by proxy"
+		}
+		if !m.shuttingDown.CompareAndSwap(false, true) {
+			slog.Info("shutdown requested while one is in progress", "reason", body.Reason)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		ctx, span := startSpan(withLogger(context.Background(), slog.With("run", newID())), "shutdown",
+			attribute.String("shutdown.reason", body.Reason))
+		logger(ctx).Info("shutdown requested", "reason", body.Reason)
+		go func() {
+			defer m.shuttingDown.Store(false)
+			err := m.gracefulShutdown(ctx, body.Reason)
+			if err != nil {
+				logger(ctx).Error("shutdown failed", "err", err)
+			} else if m.stopMethod != "noop" {
+				m.notify.send("shutdown", "reason", body.Reason)
+			}
+			endSpan(span, err)
+		}()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	go func() {
+		slog.Info("control server listening", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("control server failed", "err", err)
+		}
+	}()
+}
+
+// gracefulShutdown warns online players, saves the world and then stops the server, regardless of
+// whether anyone is still playing.
+func (m *Monitor) gracefulShutdown(ctx context.Context, reason string) error {
+	log := logger(ctx)
+	warning := fmt.Sprintf("Server closing in %v (%s)", m.shutdownGrace, reason)
+	if m.stopMethod != "azure" {
+		return m.stop(ctx, warning, m.shutdownGrace)
+	}
+
+	// The azure method stops the container without a warning, so broadcast one and save first.
+	if conn, err := rcon.Dial(m.rconAddr, m.rconPassword); err == nil {
+		if _, err := conn.Execute("say " + warning); err != nil {
+			log.Warn("warning message failed", "err", err)
+		}
+		time.Sleep(m.shutdownGrace)
+		if _, err := conn.Execute("save-all flush"); err != nil {
+			log.Warn("save-all failed", "err", err)
+		}
+		conn.Close()
+	} else {
+		log.Warn("RCON unavailable, stopping without warning", "err", err)
+	}
+	return m.stop(ctx, warning, 0)
+}
+
+// serveHealth exposes /healthz and /readyz for container probes. /healthz fails if the check loop has
+// stalled; /readyz fails until the last RCON check succeeded.
+func (m *Monitor) serveHealth(addr string) {
+	if addr == "" {
+		return
+	}
+	report := func(w http.ResponseWriter, ready bool) {
+		m.healthMu.Lock()
+		// the loop starts after a minute's wait for the server, then checks every interval
+		since := m.lastCheck
+		if since.IsZero() {
+			since = m.started.Add(time.Minute)
+		}
+		alive := time.Since(since) < 3*m.checkInterval
+		rconOK := !m.lastCheck.IsZero() && m.lastCheckErr == nil
+		body := map[string]any{
+			"alive":      alive,
+			"rcon_ok":    rconOK,
+			"last_check": m.lastCheck,
+		}
+		if m.lastCheckErr != nil {
+			body["error"] = m.lastCheckErr.Error()
+		}
+		m.healthMu.Unlock()
+
+		ok := alive
+		if ready {
+			ok = alive && rconOK
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(body)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) { report(w, false) })
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) { report(w, true) })
+	go func() {
+		slog.Info("health server listening", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("health server failed", "err", err)
+		}
+	}()
+}
+
+// setupLogging installs a JSON (or, with LOG_FORMAT=text, plain text) slog handler at LOG_LEVEL
+// (debug, info, warn or error; default info). DEBUG=1 is shorthand for LOG_LEVEL=debug.
+func setupLogging() {
+	level := slog.LevelInfo
+	if env("DEBUG", "0") == "1" {
+		level = slog.LevelDebug
+	}
+	if v := env("LOG_LEVEL", ""); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			defer slog.Warn("invalid LOG_LEVEL, using info", "value", v)
+			level = slog.LevelInfo
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+		if a.Value.Kind() == slog.KindDuration {
+			a.Value = slog.StringValue(a.Value.Duration().String())
+		}
+		return a
+	}}
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if strings.EqualFold(env("LOG_FORMAT", "json"), "text") {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h).With("service", "player-monitor"))
+}
+
+type loggerKey struct{}
+
+// withLogger returns ctx carrying l, so everything done for one run logs with its ID.
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// logger returns the logger carried by ctx, or the default one.
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// newID returns a short random hex ID for correlating log lines.
+func newID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
 func env(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -230,7 +487,7 @@ func env(key, def string) string {
 func duration(s string) time.Duration {
 	d, err := time.ParseDuration(s)
 	if err != nil {
-		log.Printf("Invalid duration %q, using 30s", s)
+		slog.Warn("invalid duration, using 30s", "value", s)
 		return 30 * time.Second
 	}
 	return d
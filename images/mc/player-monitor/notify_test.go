@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifySend(t *testing.T) {
+	bodies := make(chan map[string]any, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]any
+		json.NewDecoder(r.Body).Decode(&v)
+		bodies <- v
+	}))
+	defer srv.Close()
+
+	t.Setenv("NOTIFY_TEMPLATE_SHUTDOWN", "Going down: {reason}")
+	n := &notifier{
+		targets: []webhookTarget{{"discord", srv.URL}, {"slack", srv.URL}, {"json", srv.URL}},
+		dedup:   time.Minute,
+		client:  srv.Client(),
+		queue:   make(chan notification, 10),
+		sent:    map[string]time.Time{},
+	}
+	go n.run()
+	defer close(n.queue)
+
+	n.send("shutdown", "reason", "<!channel> quiet hours")
+	n.send("shutdown", "reason", "again") // duplicate
+	for i, want := range []struct{ key, text string }{
+		{"content", "Going down: <!channel> quiet hours"},
+		{"text", "Going down: &lt;!channel&gt; quiet hours"},
+		{"text", "Going down: <!channel> quiet hours"},
+	} {
+		select {
+		case v := <-bodies:
+			if v[want.key] != want.text {
+				t.Errorf("payload %d = %v, want %s %q", i, v, want.key, want.text)
+			}
+			if i == 0 && v["allowed_mentions"] == nil {
+				t.Errorf("discord payload %v allows mentions", v)
+			}
+			if i == 2 && (v["event"] != "shutdown" || v["source"] != "player-monitor") {
+				t.Errorf("json payload = %v, want the event and its source", v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the notification")
+		}
+	}
+	select {
+	case v := <-bodies:
+		t.Errorf("duplicate notification delivered: %v", v)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotifyDeliver(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		wantHits int32
+	}{
+		{"server error then ok", []int{500, 502, 204}, false, 3},
+		{"rate limited then ok", []int{429, 200}, false, 2},
+		{"client error", []int{400}, true, 1},
+		{"gives up", []int{500, 500, 500, 500, 500}, true, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				i := int(hits.Add(1)) - 1
+				if tc.statuses[i] == 429 {
+					w.Header().Set("Retry-After", "0.01")
+				}
+				w.WriteHeader(tc.statuses[i])
+			}))
+			defer srv.Close()
+
+			n := &notifier{retries: 2, backoff: time.Millisecond, client: srv.Client()}
+			err := n.deliver(webhookTarget{"json", srv.URL}, notification{Event: "sleep", Text: "asleep"})
+			if (err != nil) != tc.wantErr || hits.Load() != tc.wantHits {
+				t.Errorf("err %v after %d attempts, want error %v after %d", err, hits.Load(), tc.wantErr, tc.wantHits)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+)
+
+// adminMux serves /metrics and the operator API on ADMIN_ADDR. Features register their endpoints on it
+// during startup.
+var adminMux = http.NewServeMux()
+
+func startAdminServer(addr string) {
+	if addr == "" {
+		return
+	}
+	adminMux.Handle("GET /metrics", metrics)
+	go func() {
+		slog.Info("admin server listening", "addr", addr)
+		if err := http.ListenAndServe(addr, adminMux); err != nil {
+			slog.Error("admin server failed", "err", err)
+		}
+	}()
+}
+
+// requireAdmin guards mutating operator endpoints with a bearer token from ADMIN_TOKEN. With no token
+// configured those endpoints are disabled rather than left open.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getEnv("ADMIN_TOKEN", "")
+		if token == "" {
+			http.Error(w, "ADMIN_TOKEN not configured", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// onlineAuth lets the proxy check who a player is before it wakes the backend for them, since the name
+// in Login Start can be anything. It does what an online-mode server does at login: sends Encryption
+// Request with its own key, has the session server confirm the player joined with the resulting
+// secret, and encrypts the rest of the connection. It is opt-in (ONLINE_AUTH=1) and only applies to
+// logins the proxy answers itself, i.e. while the backend is asleep; players go straight to an awake
+// backend, which authenticates them as usual.
+//
+// An authenticated 1.20.5+ client is then held in the configuration phase until the backend is ready
+// (up to ONLINE_AUTH_HOLD_S) and transferred back to the proxy, which passes the transfer on as an
+// ordinary login. Older clients, which can't be transferred, get the usual "try again" disconnect.
+type onlineAuth struct {
+	key           *rsa.PrivateKey
+	publicKey     []byte // DER, as sent in Encryption Request
+	sessionServer string
+	preventProxy  bool // also send the player's IP, so the session server rejects joins from elsewhere
+	client        *http.Client
+	message       string
+	hold          time.Duration
+	transferHost  string
+	transferPort  int
+}
+
+var auth *onlineAuth
+
+// Timings for authentication and holding. The client talks to the session server before answering
+// Encryption Request, so it gets longer than other login reads.
+const (
+	authReadTimeout   = 15 * time.Second
+	holdKeepAlive     = 10 * time.Second
+	holdCheckInterval = 500 * time.Millisecond
+)
+
+var errNotAuthenticated = errors.New("session server did not confirm the join")
+
+func newOnlineAuth() *onlineAuth {
+	if getEnv("ONLINE_AUTH", "0") != "1" {
+		return nil
+	}
+	// 1024 bits is what the client expects; the key only protects the shared secret for one login
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		slog.Error("failed to generate key, online authentication disabled", "err", err)
+		return nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		slog.Error("failed to encode public key, online authentication disabled", "err", err)
+		return nil
+	}
+	a := &onlineAuth{
+		key:           key,
+		publicKey:     der,
+		sessionServer: strings.TrimSuffix(getEnv("ONLINE_AUTH_SESSION_SERVER", "https://sessionserver.mojang.com"), "/"),
+		preventProxy:  getEnv("ONLINE_AUTH_PREVENT_PROXY", "0") == "1",
+		client:        &http.Client{Timeout: 10 * time.Second},
+		message:       getEnv("ONLINE_AUTH_MESSAGE", "§cCouldn't verify your Minecraft account.\n§7Try restarting your game and launcher."),
+		hold:          time.Duration(getEnvInt("ONLINE_AUTH_HOLD_S", 300)) * time.Second,
+		transferHost:  getEnv("ONLINE_AUTH_TRANSFER_HOST", ""),
+		transferPort:  getEnvInt("ONLINE_AUTH_TRANSFER_PORT", 0),
+	}
+	metrics.describe("mcproxy_online_auth_total", "counter", "Logins authenticated by the proxy, by result.")
+	slog.Info("online authentication enabled", "session_server", a.sessionServer, "hold", a.hold)
+	return a
+}
+
+// gameProfile is a player's account as the session server describes it.
+type gameProfile struct {
+	ID         string `json:"id"` // without dashes
+	Name       string `json:"name"`
+	Properties []struct {
+		Name      string `json:"name"`
+		Value     string `json:"value"`
+		Signature string `json:"signature,omitempty"`
+	} `json:"properties"`
+}
+
+// authenticate runs the encryption handshake with a client that has sent Login Start and asks the
+// session server whether it owns the account it named. The returned connection encrypts everything
+// from then on; it's non-nil whenever the client has switched to encryption, so a failure can still be
+// reported with a disconnect over it.
+func (a *onlineAuth) authenticate(ctx context.Context, conn net.Conn, info clientInfo) (net.Conn, *gameProfile, error) {
+	enc, profile, err := a.handshake(ctx, conn, info)
+	result := "ok"
+	switch {
+	case errors.Is(err, errNotAuthenticated):
+		result = "rejected"
+	case err != nil:
+		result = "error"
+	}
+	metrics.inc("mcproxy_online_auth_total", "result", result)
+	return enc, profile, err
+}
+
+func (a *onlineAuth) handshake(ctx context.Context, conn net.Conn, info clientInfo) (net.Conn, *gameProfile, error) {
+	token := make([]byte, 4)
+	rand.Read(token)
+	pkt := appendString([]byte{0x01}, "") // server ID, empty since 1.7
+	pkt = appendBytes(pkt, a.publicKey)
+	pkt = appendBytes(pkt, token)
+	if info.protocol >= protocol1_20_5 {
+		pkt = append(pkt, 1) // should authenticate
+	}
+	if err := writePacket(conn, pkt); err != nil {
+		return nil, nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(authReadTimeout))
+	resp, err := readPacket(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading Encryption Response: %w", err)
+	}
+	encSecret, encToken, err := parseEncryptionResponse(resp, info.protocol)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := rsa.DecryptPKCS1v15(nil, a.key, encSecret)
+	if err != nil || len(secret) != 16 {
+		return nil, nil, fmt.Errorf("invalid shared secret")
+	}
+	enc, err := newEncryptedConn(conn, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 1.19 clients with chat signing keys sign a salt instead of echoing the token; the session server
+	// check below is what proves who they are either way
+	if encToken != nil {
+		if got, err := rsa.DecryptPKCS1v15(nil, a.key, encToken); err != nil || !bytes.Equal(got, token) {
+			return enc, nil, fmt.Errorf("verify token mismatch")
+		}
+	}
+
+	profile, err := a.hasJoined(ctx, info.username, serverHash([]byte(""), secret, a.publicKey), remoteIP(conn.RemoteAddr()))
+	return enc, profile, err
+}
+
+// parseEncryptionResponse returns the encrypted shared secret and verify token from Encryption
+// Response. The token is nil if a 1.19-1.19.2 client sent a signature instead.
+func parseEncryptionResponse(packet []byte, protocol int32) (secret, token []byte, err error) {
+	if len(packet) < 1 || packet[0] != 0x01 {
+		return nil, nil, fmt.Errorf("expected Encryption Response")
+	}
+	offset := 1
+	if secret, offset, err = readBytes(packet, offset); err != nil {
+		return nil, nil, err
+	}
+	if protocol >= protocol1_19 && protocol < protocol1_19_3 {
+		if offset >= len(packet) {
+			return nil, nil, fmt.Errorf("truncated Encryption Response")
+		}
+		if packet[offset] == 0 {
+			return secret, nil, nil
+		}
+		offset++
+	}
+	if token, _, err = readBytes(packet, offset); err != nil {
+		return nil, nil, err
+	}
+	return secret, token, nil
+}
+
+// hasJoined asks the session server whether name joined the server identified by hash.
+func (a *onlineAuth) hasJoined(ctx context.Context, name, hash, ip string) (*gameProfile, error) {
+	q := url.Values{"username": {name}, "serverId": {hash}}
+	if a.preventProxy {
+		q.Set("ip", ip)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.sessionServer+"/session/minecraft/hasJoined?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, errNotAuthenticated
+	default:
+		return nil, fmt.Errorf("session server returned %s", resp.Status)
+	}
+	var p gameProfile
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, fmt.Errorf("decoding profile: %w", err)
+	}
+	if id, err := hex.DecodeString(p.ID); err != nil || len(id) != 16 || !strings.EqualFold(p.Name, name) {
+		return nil, fmt.Errorf("session server returned an unexpected profile %q (%s)", p.Name, p.ID)
+	}
+	return &p, nil
+}
+
+// uuid is the profile's ID in dashed form.
+func (p *gameProfile) uuid() string {
+	id, _ := hex.DecodeString(p.ID)
+	return formatUUID(id)
+}
+
+// serverHash is Minecraft's digest of the server ID, shared secret and public key: SHA-1, printed as a
+// signed (two's complement) hex number without leading zeros.
+func serverHash(parts ...[]byte) string {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	sum := h.Sum(nil)
+	negative := sum[0]&0x80 != 0
+	if negative {
+		carry := true
+		for i := len(sum) - 1; i >= 0; i-- {
+			sum[i] = ^sum[i]
+			if carry {
+				sum[i]++
+				carry = sum[i] == 0
+			}
+		}
+	}
+	s := strings.TrimLeft(hex.EncodeToString(sum), "0")
+	if negative {
+		s = "-" + s
+	}
+	return s
+}
+
+// canHold reports whether an authenticated player can wait for the backend on the proxy rather than
+// being disconnected: transfers are 1.20.5+.
+func (a *onlineAuth) canHold(info clientInfo) bool {
+	return a != nil && a.hold > 0 && info.protocol >= protocol1_20_5
+}
+
+// holdAndTransfer finishes the login of an authenticated player and keeps them in the configuration
+// phase, which the client shows as joining the world, until the backend is ready. Then it transfers
+// them to the proxy's own address, where they arrive as a new login and are sent to the backend.
+// started delivers the outcome of the wake requested for them; once that's known, a player with
+// nothing left to wait for (the start failed or was skipped, and no other wake is under way) is
+// disconnected rather than held.
+func (a *onlineAuth) holdAndTransfer(ctx context.Context, conn net.Conn, info clientInfo, p *gameProfile, started <-chan string) error {
+	if err := writePacket(conn, loginSuccess(p, info.protocol)); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(authReadTimeout))
+	ack, err := readPacket(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("waiting for Login Acknowledged: %w", err)
+	}
+	if ack[0] != 0x03 {
+		return fmt.Errorf("expected Login Acknowledged, got packet 0x%02x", ack[0])
+	}
+
+	// The client sends its settings, brand and keep-alive replies meanwhile; none of them matter here.
+	gone := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := readPacket(conn); err != nil {
+				gone <- err
+				return
+			}
+		}
+	}()
+	disconnect := func() {
+		writePacket(conn, configDisconnect(getEnv("DISCONNECT_MESSAGE_2", "§eGet some water and try reconnecting in a minute while the server starts up!")))
+	}
+	logger(ctx).Info("holding player until the backend is ready")
+	deadline := time.NewTimer(a.hold)
+	defer deadline.Stop()
+	keepAlive := time.NewTicker(holdKeepAlive)
+	defer keepAlive.Stop()
+	check := time.NewTicker(holdCheckInterval)
+	defer check.Stop()
+	wake := ""
+	for {
+		select {
+		case err := <-gone:
+			return fmt.Errorf("player left while held: %w", err)
+		case <-deadline.C:
+			disconnect()
+			return fmt.Errorf("backend not ready after %v", a.hold)
+		case <-keepAlive.C:
+			if err := writePacket(conn, binary.BigEndian.AppendUint64([]byte{0x04}, uint64(time.Now().UnixMilli()))); err != nil {
+				return err
+			}
+		case wake = <-started:
+			started = nil
+		case <-check.C:
+			if backend.readiness() != backendReady {
+				// a backend ARM says is running gets until the hold deadline to become ready
+				if wake != "" && wake != "running" && !wakePending() {
+					disconnect()
+					return fmt.Errorf("no wake under way (ours: %s)", wake)
+				}
+				continue
+			}
+			host, port := info.host, info.port
+			if a.transferHost != "" {
+				host = a.transferHost
+			}
+			if a.transferPort != 0 {
+				port = a.transferPort
+			}
+			logger(ctx).Info("backend ready, transferring held player", "host", host, "port", port)
+			return writePacket(conn, appendVarInt(appendString([]byte{0x0B}, host), int32(port)))
+		}
+	}
+}
+
+// loginSuccess builds Login Success for p, which moves a 1.20.2+ client on to configuration once
+// acknowledged.
+func loginSuccess(p *gameProfile, protocol int32) []byte {
+	id, _ := hex.DecodeString(p.ID)
+	pkt := append([]byte{0x02}, id...)
+	pkt = appendString(pkt, p.Name)
+	pkt = appendVarInt(pkt, int32(len(p.Properties)))
+	for _, prop := range p.Properties {
+		pkt = appendString(appendString(pkt, prop.Name), prop.Value)
+		if prop.Signature != "" {
+			pkt = appendString(append(pkt, 1), prop.Signature)
+		} else {
+			pkt = append(pkt, 0)
+		}
+	}
+	if protocol >= protocol1_20_5 && protocol < protocol1_21_2 {
+		pkt = append(pkt, 0) // strict error handling
+	}
+	return pkt
+}
+
+// configDisconnect builds a configuration phase Disconnect, whose reason is NBT: a string tag is a
+// plain text component.
+func configDisconnect(message string) []byte {
+	pkt := append([]byte{0x02, 0x08}, byte(len(message)>>8), byte(len(message)))
+	return append(pkt, message...)
+}
+
+// transferAsLogin turns the handshake of a transfer (next state 3) into a login's in place, so a player
+// transferred back by holdAndTransfer reaches a backend that doesn't accept transfers.
+func transferAsLogin(handshake []byte) bool {
+	if len(handshake) == 0 || handshake[len(handshake)-1] != 3 {
+		return false
+	}
+	handshake[len(handshake)-1] = 2
+	return true
+}
+
+// handshakeAddr returns the server address and port a client put in its handshake, without anything
+// mod loaders append to the address.
+func handshakeAddr(packet []byte) (string, int) {
+	offset := 1
+	_, n, err := readVarIntFromBytes(packet, offset)
+	if err != nil {
+		return "", 0
+	}
+	host, offset, err := readBytes(packet, offset+n)
+	if err != nil || offset+2 > len(packet) {
+		return "", 0
+	}
+	h, _, _ := strings.Cut(string(host), "\x00")
+	return h, int(binary.BigEndian.Uint16(packet[offset:]))
+}
+
+// encryptedConn is a connection after the login encryption handshake: AES/CFB8 both ways, with the
+// shared secret as key and IV.
+type encryptedConn struct {
+	net.Conn
+	dec, enc cipher.Stream
+}
+
+func newEncryptedConn(conn net.Conn, secret []byte) (*encryptedConn, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedConn{Conn: conn, dec: newCFB8(block, secret, true), enc: newCFB8(block, secret, false)}, nil
+}
+
+func (c *encryptedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.dec.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (c *encryptedConn) Write(b []byte) (int, error) {
+	out := make([]byte, len(b))
+	c.enc.XORKeyStream(out, b)
+	return c.Conn.Write(out)
+}
+
+// cfb8 is CFB mode with 8-bit segments, which the protocol uses and crypto/cipher doesn't provide.
+type cfb8 struct {
+	block   cipher.Block
+	sr, out []byte
+	decrypt bool
+}
+
+func newCFB8(block cipher.Block, iv []byte, decrypt bool) *cfb8 {
+	return &cfb8{block: block, sr: bytes.Clone(iv), out: make([]byte, block.BlockSize()), decrypt: decrypt}
+}
+
+func (x *cfb8) XORKeyStream(dst, src []byte) {
+	for i, b := range src {
+		x.block.Encrypt(x.out, x.sr)
+		c := b ^ x.out[0]
+		copy(x.sr, x.sr[1:])
+		if x.decrypt {
+			x.sr[len(x.sr)-1] = b
+		} else {
+			x.sr[len(x.sr)-1] = c
+		}
+		dst[i] = c
+	}
+}
+
+// writePacket frames packet and writes it in one go.
+func writePacket(conn net.Conn, packet []byte) error {
+	_, err := conn.Write(append(appendVarInt(make([]byte, 0, len(packet)+5), int32(len(packet))), packet...))
+	return err
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendVarInt(b, int32(len(s))), s...)
+}
+
+func appendBytes(b, v []byte) []byte {
+	return append(appendVarInt(b, int32(len(v))), v...)
+}
+
+// readBytes reads a VarInt-prefixed byte array at offset, returning it and the offset after it.
+func readBytes(b []byte, offset int) ([]byte, int, error) {
+	n, m, err := readVarIntFromBytes(b, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += m
+	if n < 0 || offset+int(n) > len(b) {
+		return nil, 0, fmt.Errorf("byte array runs past the packet")
+	}
+	return b[offset : offset+int(n)], offset + int(n), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestServerHash(t *testing.T) {
+	// the examples from the protocol documentation
+	for name, want := range map[string]string{
+		"Notch": "4ed1f46bbe04bc756bcb17c0c7ce3e4632f06a48",
+		"jeb_":  "-7c9d5b0044c130109a5d7b5fb5c317c02b4e28c1",
+		"simon": "88e16a1019277b15d58faf0541e11910eb756f6",
+	} {
+		if got := serverHash([]byte(name)); got != want {
+			t.Errorf("serverHash(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestCFB8RoundTrip(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	block, _ := aes.NewCipher(secret)
+	enc, dec := newCFB8(block, secret, false), newCFB8(block, secret, true)
+	msg := []byte("a login packet, then some more bytes of the session")
+	out := make([]byte, len(msg))
+	// in pieces, the way it's read and written
+	enc.XORKeyStream(out[:7], msg[:7])
+	enc.XORKeyStream(out[7:], msg[7:])
+	if bytes.Equal(out, msg) {
+		t.Fatal("not encrypted")
+	}
+	dec.XORKeyStream(out[:20], out[:20])
+	dec.XORKeyStream(out[20:], out[20:])
+	if !bytes.Equal(out, msg) {
+		t.Fatalf("round trip gave %q", out)
+	}
+}
+
+func TestParseEncryptionResponse(t *testing.T) {
+	secret, token := []byte("secret"), []byte("token")
+	modern := appendBytes(appendBytes([]byte{0x01}, secret), token)
+	if s, tok, err := parseEncryptionResponse(modern, 767); err != nil || !bytes.Equal(s, secret) || !bytes.Equal(tok, token) {
+		t.Errorf("1.21: %q %q %v", s, tok, err)
+	}
+	withToken := appendBytes(append(appendBytes([]byte{0x01}, secret), 1), token)
+	if s, tok, err := parseEncryptionResponse(withToken, protocol1_19); err != nil || !bytes.Equal(s, secret) || !bytes.Equal(tok, token) {
+		t.Errorf("1.19 with token: %q %q %v", s, tok, err)
+	}
+	signed := appendBytes(binary.BigEndian.AppendUint64(append(appendBytes([]byte{0x01}, secret), 0), 42), []byte("sig"))
+	if s, tok, err := parseEncryptionResponse(signed, protocol1_19_1); err != nil || !bytes.Equal(s, secret) || tok != nil {
+		t.Errorf("1.19.1 with signature: %q %q %v", s, tok, err)
+	}
+	if _, _, err := parseEncryptionResponse(modern[:5], 767); err == nil {
+		t.Error("truncated response parsed")
+	}
+}
+
+func TestHandshakeAddrAndTransfer(t *testing.T) {
+	hs := appendString(appendVarInt([]byte{0x00}, 767), "mc.example.com\x00FML3\x00")
+	hs = append(hs, 0x63, 0xdd, 3) // port 25565, next state 3
+	if host, port := handshakeAddr(hs); host != "mc.example.com" || port != 25565 {
+		t.Errorf("handshakeAddr = %q %d", host, port)
+	}
+	if !transferAsLogin(hs) {
+		t.Fatal("transfer not rewritten")
+	}
+	if ns, proto, err := parseHandshake(hs); err != nil || ns != 2 || proto != 767 {
+		t.Errorf("rewritten handshake parses as state %d protocol %d (%v)", ns, proto, err)
+	}
+	if transferAsLogin(hs) {
+		t.Error("a login was rewritten")
+	}
+}
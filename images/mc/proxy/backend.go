@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// probeBackend performs a Server List Ping against addr and returns the raw status JSON. A successful
+// probe means the Minecraft server itself is accepting players, not just that something holds the port.
+// In Bedrock mode it's a RakNet ping instead, returning the pong's server ID string.
+func probeBackend(addr string, timeout time.Duration) ([]byte, error) {
+	if bedrockMode.Load() {
+		return probeBedrock(addr, timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := dialBackend(ctx, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	host, port := backendHostPort(addr, conn)
+
+	// Handshake: [id 0x00] [protocol VarInt] [host string] [port u16] [next state VarInt = 1 (status)]
+	var hs []byte
+	hs = append(hs, 0x00)
+	hs = appendVarInt(hs, -1)
+	hs = appendVarInt(hs, int32(len(host)))
+	hs = append(hs, host...)
+	hs = binary.BigEndian.AppendUint16(hs, port)
+	hs = appendVarInt(hs, 1)
+
+	var out []byte
+	out = appendVarInt(out, int32(len(hs)))
+	out = append(out, hs...)
+	out = append(out, 0x01, 0x00) // Status Request
+	if _, err := conn.Write(out); err != nil {
+		return nil, err
+	}
+
+	packet, err := readPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+	if packet[0] != 0x00 {
+		return nil, fmt.Errorf("unexpected status packet id 0x%02x", packet[0])
+	}
+	n, m, err := readVarIntFromBytes(packet, 1)
+	if err != nil {
+		return nil, err
+	}
+	if 1+m+int(n) > len(packet) {
+		return nil, fmt.Errorf("truncated status response")
+	}
+	return packet[1+m : 1+m+int(n)], nil
+}
+
+// backendWatcher tracks whether the backend is up by probing it periodically, so features that care
+// about the backend lifecycle (runtime budget, quiet hours) share one view of it instead of each
+// dialing the server on their own.
+type backendWatcher struct {
+	addr         string
+	interval     time.Duration
+	readyTTL     time.Duration // how long a successful probe vouches for the backend
+	readyTimeout time.Duration // timeout for an on-demand probe when the cache is stale
+
+	mu        sync.Mutex
+	up        bool
+	changed   time.Time
+	lastOK    time.Time
+	status    []byte // status JSON from the last successful probe
+	failures  int
+	listeners []func(up bool, at time.Time)
+}
+
+var backend *backendWatcher
+
+func newBackendWatcher(addr string) *backendWatcher {
+	return &backendWatcher{
+		addr:         addr,
+		interval:     time.Duration(getEnvInt("BACKEND_PROBE_S", 30)) * time.Second,
+		readyTTL:     time.Duration(getEnvInt("READY_CACHE_S", 10)) * time.Second,
+		readyTimeout: time.Duration(getEnvInt("READY_PROBE_MS", 1500)) * time.Millisecond,
+		changed:      time.Now(),
+	}
+}
+
+// onChange registers fn to be called (outside the watcher's lock) whenever the backend goes up or down.
+func (b *backendWatcher) onChange(fn func(up bool, at time.Time)) {
+	b.mu.Lock()
+	b.listeners = append(b.listeners, fn)
+	b.mu.Unlock()
+}
+
+func (b *backendWatcher) run() {
+	for {
+		b.probe()
+		time.Sleep(b.nextProbe())
+	}
+}
+
+// nextProbe is how long to wait before probing again. While the backend is up, that's often enough to
+// keep readiness's cached result fresh, so joins never wait for a probe of their own.
+func (b *backendWatcher) nextProbe() time.Duration {
+	if ttl := b.readyTTL / 2; b.isUp() && ttl > 0 && ttl < b.interval {
+		return ttl
+	}
+	return b.interval
+}
+
+// probe checks the backend once.
+func (b *backendWatcher) probe() {
+	at := time.Now()
+	status, err := probeBackend(b.addr, 3*time.Second)
+	b.observe(at, status, err)
+}
+
+// observe records a probe result. It takes two failed probes in a row to declare the backend down so a
+// single slow response doesn't end a runtime period.
+func (b *backendWatcher) observe(at time.Time, status []byte, err error) {
+	b.mu.Lock()
+	was := b.up
+	// the live player sample shows who the backend says is online
+	reported := err == nil && !bytes.Equal(status, b.status)
+	if err == nil {
+		b.failures = 0
+		b.up = true
+		b.lastOK = at
+		b.status = status
+	} else {
+		b.failures++
+		if b.failures >= 2 {
+			b.up = false
+		}
+	}
+	changed, up := b.up != was, b.up
+	var listeners []func(bool, time.Time)
+	if changed {
+		b.changed = at
+		listeners = append(listeners, b.listeners...)
+	}
+	b.mu.Unlock()
+	if reported {
+		invalidateStatus()
+	}
+	if !changed {
+		return
+	}
+
+	slog.Info("backend state changed", "backend", b.addr, "up", up)
+	for _, fn := range listeners {
+		fn(up, at)
+	}
+}
+
+// lastStatus returns the status JSON from the last successful probe, which may be from before the
+// backend went down, or nil if it has never answered.
+func (b *backendWatcher) lastStatus() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status
+}
+
+func (b *backendWatcher) isUp() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.up
+}
+
+// readiness is the proxy's answer to "can this player be sent to the backend right now?".
+type readiness int
+
+func (r readiness) String() string {
+	switch r {
+	case backendReady:
+		return "ready"
+	case backendNotReady:
+		return "not_ready"
+	}
+	return "unknown"
+}
+
+const (
+	readinessUnknown readiness = iota // probe timed out; fall back to watching the backend connection
+	backendReady
+	backendNotReady
+)
+
+// readiness decides whether the backend can take a player without touching the player's connection. A
+// recent successful probe is trusted as-is, so healthy joins pay no extra latency; otherwise the backend
+// is probed on the spot.
+func (b *backendWatcher) readiness() readiness {
+	if inFlight, _, _ := wakes.progress(); inFlight {
+		return backendNotReady
+	}
+	b.mu.Lock()
+	fresh := time.Since(b.lastOK) < b.readyTTL
+	b.mu.Unlock()
+	if fresh {
+		return backendReady
+	}
+
+	at := time.Now()
+	status, err := probeBackend(b.addr, b.readyTimeout)
+	b.observe(at, status, err)
+	if err == nil {
+		return backendReady
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return readinessUnknown
+	}
+	return backendNotReady
+}
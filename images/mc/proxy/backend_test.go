@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatcherKeepsReadyCacheFresh(t *testing.T) {
+	b := &backendWatcher{interval: 30 * time.Second, readyTTL: 10 * time.Second}
+	if d := b.nextProbe(); d != 30*time.Second {
+		t.Errorf("backend down: next probe in %v, want the probe interval", d)
+	}
+	b.observe(time.Now(), []byte("{}"), nil)
+	if d := b.nextProbe(); d >= b.readyTTL {
+		t.Errorf("backend up: next probe in %v, which lets the %v ready cache go stale", d, b.readyTTL)
+	}
+	b.readyTTL = 0 // cache disabled
+	if d := b.nextProbe(); d != 30*time.Second {
+		t.Errorf("cache disabled: next probe in %v, want the probe interval", d)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bedrockMode (PROXY_MODE=bedrock) turns every listener into a UDP proxy for Bedrock Edition. Bedrock
+// speaks RakNet: server lists send Unconnected Pings, which the proxy always answers itself (with the
+// backend's pong while it's up), and joining starts with an Open Connection Request, which wakes it.
+// Once the backend is up, each joining client gets its own socket to the backend and datagrams are
+// relayed both ways unchanged.
+var bedrockMode atomic.Bool
+
+// RakNet message IDs and the "offline message" magic every unconnected packet carries.
+const (
+	raknetUnconnectedPing     = 0x01
+	raknetUnconnectedPingOpen = 0x02
+	raknetOpenConnectionReq1  = 0x05
+	raknetUnconnectedPong     = 0x1C
+)
+
+var raknetMagic = []byte{0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe, 0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78}
+
+// defaultListenAddr is where the single listener binds without LISTEN_ADDR.
+func defaultListenAddr() string {
+	if bedrockMode.Load() {
+		return ":19132"
+	}
+	return ":25565"
+}
+
+// probeBedrock sends an Unconnected Ping to each address of addr in turn and returns the first pong's
+// server ID string ("MCPE;motd;protocol;version;online;max;...").
+func probeBedrock(addr string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	candidates, err := resolveBackend(ctx, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "udp", Err: err}
+	}
+	var lastErr error
+	for _, c := range candidates {
+		id, err := pingBedrock(c, timeout)
+		if err == nil {
+			bedrockAnswered.Store(addr, c)
+			return id, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// bedrockAnswered maps a backend address to the candidate that answered its last probe, which is where
+// relays for it go.
+var bedrockAnswered sync.Map
+
+// pingBedrock sends an Unconnected Ping to one host:port and returns the pong's server ID string.
+func pingBedrock(addr string, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	ping := []byte{raknetUnconnectedPing}
+	ping = binary.BigEndian.AppendUint64(ping, uint64(time.Now().UnixMilli()))
+	ping = append(ping, raknetMagic...)
+	ping = binary.BigEndian.AppendUint64(ping, 0) // client GUID
+	if _, err := conn.Write(ping); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	// id, time, server GUID, magic, string length, string
+	if n < 35 || buf[0] != raknetUnconnectedPong || !bytes.Equal(buf[17:33], raknetMagic) {
+		return nil, fmt.Errorf("unexpected RakNet reply 0x%02x (%d bytes)", buf[0], n)
+	}
+	l := int(binary.BigEndian.Uint16(buf[33:35]))
+	if 35+l > n {
+		return nil, fmt.Errorf("truncated RakNet pong")
+	}
+	return append([]byte(nil), buf[35:35+l]...), nil
+}
+
+// bedrockListener serves one listener in Bedrock mode.
+type bedrockListener struct {
+	l          *proxyListener
+	conn       net.PacketConn
+	guid       uint64
+	idle       time.Duration
+	maxClients int
+
+	mu      sync.Mutex
+	relays  map[string]*bedrockRelay // client address -> relay
+	pongID  string                   // backend's server ID, for listeners whose backend isn't watched
+	pongAt  time.Time
+	probing bool
+}
+
+// bedrockPongTTL is how long a listener whose backend isn't watched answers pings with the server ID
+// from its last probe of the backend.
+const bedrockPongTTL = 5 * time.Second
+
+// bedrockRelay is one client's socket to the backend. It stands in for the client connection in the
+// session log: RemoteAddr is the client, Close ends the relay.
+type bedrockRelay struct {
+	*net.UDPConn
+	client   net.Addr
+	sess     *session
+	lastSeen atomic.Int64 // unix nanos of the last datagram either way
+	idled    atomic.Bool  // closed by the reaper
+}
+
+func (r *bedrockRelay) RemoteAddr() net.Addr { return r.client }
+
+// startBedrockListener binds l's UDP socket and serves it until the returned socket is closed.
+func startBedrockListener(l *proxyListener) (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", l.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var guid [8]byte
+	rand.Read(guid[:])
+	b := &bedrockListener{
+		l:          l,
+		conn:       conn,
+		guid:       binary.BigEndian.Uint64(guid[:]),
+		idle:       time.Duration(getEnvInt("BEDROCK_IDLE_S", 60)) * time.Second,
+		maxClients: getEnvInt("BEDROCK_MAX_CLIENTS", 256),
+		relays:     map[string]*bedrockRelay{},
+	}
+	metrics.describe("mcproxy_bedrock_pongs_total", "counter", "Unconnected Pings answered by the proxy while the backend was down.")
+	go b.run()
+	go b.reap()
+	return conn, nil
+}
+
+func (b *bedrockListener) run() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := b.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			listening.Add(-1)
+			return
+		}
+		if err != nil {
+			slog.Warn("bedrock: read failed", "listener", b.l.Name, "err", err)
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		b.handle(buf[:n], addr)
+	}
+}
+
+func (b *bedrockListener) handle(pkt []byte, addr net.Addr) {
+	b.mu.Lock()
+	r := b.relays[addr.String()]
+	b.mu.Unlock()
+	if r != nil {
+		b.forward(r, pkt)
+		return
+	}
+
+	up := b.l.managed && backend.isUp() && !draining.Load()
+	if !b.l.managed && !draining.Load() {
+		// nothing to wake or watch; relay to whatever is there
+		up = true
+	}
+	if up {
+		// Only joins get a relay (and a session). Pings are answered for the backend, so a flood of
+		// them, spoofed or from server lists, can't use up BEDROCK_MAX_CLIENTS or the access log.
+		switch pkt[0] {
+		case raknetUnconnectedPing, raknetUnconnectedPingOpen:
+			if len(pkt) >= 25 {
+				b.conn.WriteTo(b.pong(pkt[1:9], b.backendServerID()), addr)
+			}
+		case raknetOpenConnectionReq1:
+			if r := b.newRelay(addr); r != nil {
+				b.forward(r, pkt)
+			}
+		}
+		return
+	}
+
+	switch pkt[0] {
+	case raknetUnconnectedPing, raknetUnconnectedPingOpen:
+		if len(pkt) < 25 {
+			return
+		}
+		b.conn.WriteTo(b.pong(pkt[1:9], b.serverID()), addr)
+		metrics.inc("mcproxy_bedrock_pongs_total", "listener", b.l.Name)
+	case raknetOpenConnectionReq1:
+		// The client gives up after a few seconds of silence and shows "Unable to connect to world";
+		// by then the pong MOTD tells players the server is starting, and a retry once it's up connects.
+		if draining.Load() {
+			return
+		}
+		ctx := withLogger(context.Background(), slog.With("listener", b.l.Name, "remote", addr.String()))
+		logger(ctx).Info("bedrock: join while backend is down")
+		go wakeFor(ctx, b.l, addr, clientInfo{listener: b.l.Name})
+	}
+}
+
+// pong builds an Unconnected Pong with server ID id, echoing the ping's timestamp.
+func (b *bedrockListener) pong(pingTime []byte, id string) []byte {
+	out := []byte{raknetUnconnectedPong}
+	out = append(out, pingTime...)
+	out = binary.BigEndian.AppendUint64(out, b.guid)
+	out = append(out, raknetMagic...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(id)))
+	return append(out, id...)
+}
+
+// backendServerID is the server ID to answer pings with while the backend is up: the backend's own,
+// from the watcher's last probe or, for listeners whose backend isn't watched, a probe of their own
+// at most every bedrockPongTTL. Until there is one, it's the proxy's.
+func (b *bedrockListener) backendServerID() string {
+	if b.l.managed {
+		if id := backend.lastStatus(); len(id) > 0 {
+			return string(id)
+		}
+		return b.serverID()
+	}
+	b.mu.Lock()
+	id, refresh := b.pongID, !b.probing && time.Since(b.pongAt) >= bedrockPongTTL
+	b.probing = b.probing || refresh
+	b.mu.Unlock()
+	if refresh {
+		go func() {
+			status, err := probeBedrock(b.l.Backend, backendDialTimeout)
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.probing, b.pongAt = false, time.Now()
+			if err == nil {
+				b.pongID = string(status)
+			}
+		}()
+	}
+	if id == "" {
+		return b.serverID()
+	}
+	return id
+}
+
+// serverID renders the pong's server ID string from the listener's current MOTD. The protocol and
+// version come from the backend's last pong, so clients don't list a sleeping server as outdated.
+func (b *bedrockListener) serverID() string {
+	protocol := getEnv("BEDROCK_PROTOCOL", "766")
+	version := getEnv("BEDROCK_VERSION", "1.21.50")
+	if b.l.managed {
+		if f := strings.Split(string(backend.lastStatus()), ";"); len(f) > 3 {
+			protocol, version = f[2], f[3]
+		}
+	}
+	line1, line2, _ := strings.Cut(b.l.description(), "\n")
+	if line2 == "" {
+		line2 = "Proxy"
+	}
+	_, port, _ := net.SplitHostPort(b.l.Addr)
+	clean := strings.NewReplacer(";", ",", "\n", " ")
+	return strings.Join([]string{"MCPE", clean.Replace(line1), protocol, version,
+		strconv.Itoa(getEnvInt("PLAYERS_ONLINE", 0)), strconv.Itoa(getEnvInt("PLAYERS_MAX", 10)),
+		strconv.FormatUint(b.guid, 10), clean.Replace(line2), "Survival", "1", port, port, ""}, ";")
+}
+
+// newRelay opens a socket to the backend for client, or returns nil if too many clients are being
+// relayed already.
+func (b *bedrockListener) newRelay(client net.Addr) *bedrockRelay {
+	b.mu.Lock()
+	if len(b.relays) >= b.maxClients {
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), backendDialTimeout)
+	defer cancel()
+	candidates, err := resolveBackend(ctx, b.l.Backend)
+	if err != nil {
+		slog.Warn("bedrock: resolving backend failed", "listener", b.l.Name, "backend", b.l.Backend, "err", err)
+		return nil
+	}
+	raddr, err := net.ResolveUDPAddr("udp", bedrockTarget(b.l.Backend, candidates))
+	if err != nil {
+		return nil
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		slog.Warn("bedrock: backend socket failed", "listener", b.l.Name, "err", err)
+		return nil
+	}
+	r := &bedrockRelay{UDPConn: conn, client: client}
+	r.lastSeen.Store(time.Now().UnixNano())
+
+	b.mu.Lock()
+	if existing := b.relays[client.String()]; existing != nil {
+		b.mu.Unlock()
+		conn.Close()
+		return existing
+	}
+	b.relays[client.String()] = r
+	b.mu.Unlock()
+
+	r.sess = sessions.start(r, b.l.Backend, clientInfo{connID: newID(), listener: b.l.Name})
+	go b.pump(r)
+	return r
+}
+
+// bedrockTarget picks which of addr's candidates to relay to. A UDP socket can't tell whether anything
+// is listening, so it's the candidate that answered the last probe, or else the first to answer a ping
+// now; with neither, the first candidate.
+func bedrockTarget(addr string, candidates []string) string {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	if c, ok := bedrockAnswered.Load(addr); ok && slices.Contains(candidates, c.(string)) {
+		return c.(string)
+	}
+	for _, c := range candidates {
+		if _, err := pingBedrock(c, backendDialTimeout); err == nil {
+			bedrockAnswered.Store(addr, c)
+			return c
+		}
+	}
+	return candidates[0]
+}
+
+// forward sends a client datagram to the backend.
+func (b *bedrockListener) forward(r *bedrockRelay, pkt []byte) {
+	r.lastSeen.Store(time.Now().UnixNano())
+	if n, err := r.Write(pkt); err == nil {
+		r.sess.bytesUp.Add(int64(n))
+	}
+}
+
+// pump copies backend datagrams to the client until the relay is closed.
+func (b *bedrockListener) pump(r *bedrockRelay) {
+	buf := make([]byte, 2048)
+	var reason string
+	var rerr error
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			if r.idled.Load() {
+				reason = closeIdleTimeout
+			} else if !errors.Is(err, net.ErrClosed) {
+				reason, rerr = closeError, err
+			}
+			break
+		}
+		r.lastSeen.Store(time.Now().UnixNano())
+		if n, err := b.conn.WriteTo(buf[:n], r.client); err == nil {
+			r.sess.bytesDown.Add(int64(n))
+		}
+	}
+	b.mu.Lock()
+	if b.relays[r.client.String()] == r {
+		delete(b.relays, r.client.String())
+	}
+	b.mu.Unlock()
+	r.Close()
+	sessions.finish(r.sess, reason, rerr)
+}
+
+// reap closes relays that have been quiet for BEDROCK_IDLE_S, checking every quarter of that (but at
+// most once a second). RakNet has no close the proxy can rely on seeing, so idleness is how relays end.
+func (b *bedrockListener) reap() {
+	for range time.Tick(max(b.idle/4, time.Second)) {
+		cutoff := time.Now().Add(-b.idle).UnixNano()
+		b.mu.Lock()
+		for _, r := range b.relays {
+			if r.lastSeen.Load() < cutoff {
+				r.idled.Store(true)
+				r.Close()
+			}
+		}
+		b.mu.Unlock()
+	}
+}
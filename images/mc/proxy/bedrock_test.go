@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreykaipov/infra/images/mc/proxy/internal/mctest"
+)
+
+// startBedrockProxy serves a Bedrock listener on loopback for backendAddr, whose starts go to the
+// returned fake ARM, and returns a client connected to it.
+func startBedrockProxy(t *testing.T, backendAddr string) (*mctest.RakNetClient, *mctest.ARM) {
+	t.Helper()
+	arm := mctest.NewARM("e2e-token")
+	t.Cleanup(arm.Close)
+
+	bedrockMode.Store(true)
+	t.Cleanup(func() { bedrockMode.Store(false) })
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "sub")
+	t.Setenv("AZURE_RESOURCE_GROUP", "rg")
+	t.Setenv("AZURE_CONTAINER_APP_NAME", "mc")
+	t.Setenv("AZURE_ARM_ENDPOINT", arm.URL())
+	t.Setenv("AZURE_ARM_TOKEN", "e2e-token")
+	t.Setenv("MOTD", "e2e MOTD")
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:0")
+	l, err := setupReplay("", backendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startMu.Lock()
+	lastStartTime, starting = time.Time{}, false
+	startMu.Unlock()
+
+	conn, err := startBedrockListener(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// like the drain: stop listening and close the relays, whose pumps finish their sessions
+	t.Cleanup(func() {
+		conn.Close()
+		sessions.closeAll()
+		for deadline := time.Now().Add(5 * time.Second); sessions.activeCount() > 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Error("relays still open after closing them")
+				return
+			}
+		}
+	})
+	t.Cleanup(func() { waitWakes(t) })
+	client, err := mctest.DialRakNet(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, arm
+}
+
+func TestBedrockBackendDown(t *testing.T) {
+	// the wake gives up quickly, so it's over before the test ends
+	t.Setenv("WAKE_READY_TIMEOUT_S", "1")
+	t.Setenv("WAKE_POLL_MS", "100")
+	be, err := mctest.NewBedrockBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+	client, arm := startBedrockProxy(t, be.Addr())
+
+	id, err := client.Ping(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id, "MCPE;e2e MOTD;") {
+		t.Errorf("pong server ID %q, want the proxy's MOTD", id)
+	}
+	if n := sessions.activeCount(); n != 0 {
+		t.Errorf("%d sessions relayed to a backend that's down", n)
+	}
+
+	if err := client.OpenConnection(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(arm.Starts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitWakes(t)
+	if starts := arm.Starts(); len(starts) != 1 || starts[0] != "mc" {
+		t.Errorf("ARM start requests %v, want one for mc", starts)
+	}
+	closed := func() bool {
+		budget.mu.Lock()
+		defer budget.mu.Unlock()
+		n := len(budget.state.Periods)
+		return n > 0 && !budget.state.Periods[n-1].End.IsZero()
+	}
+	for deadline := time.Now().Add(5 * time.Second); !closed(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("wake still running after it timed out")
+		}
+	}
+}
+
+func TestBedrockRelay(t *testing.T) {
+	be, err := mctest.NewBedrockBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	client, arm := startBedrockProxy(t, be.Addr())
+	backend.observe(time.Now(), []byte(be.ServerID), nil)
+
+	id, err := client.Ping(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != be.ServerID {
+		t.Errorf("pong server ID %q, want the backend's %q", id, be.ServerID)
+	}
+	if n := sessions.activeCount(); n != 0 {
+		t.Errorf("%d sessions after a ping, want none", n)
+	}
+	pkt := []byte{0x84, 0, 0, 0, 0x40, 0, 0x90, 0, 0, 0, 0x09}
+	client.Write(pkt)
+	if got, err := client.Recv(200 * time.Millisecond); err == nil {
+		t.Errorf("relayed %x before the client asked to connect", got)
+	}
+
+	joinBedrock(t, client)
+	if _, err := client.Write(pkt); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.Recv(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, pkt) {
+		t.Errorf("relayed %x, want the backend's echo %x", got, pkt)
+	}
+	if n := sessions.activeCount(); n != 1 {
+		t.Errorf("%d sessions for one client, want 1", n)
+	}
+	if starts := arm.Starts(); len(starts) != 0 {
+		t.Errorf("ARM start requests %v for a backend that's up", starts)
+	}
+}
+
+// joinBedrock sends an Open Connection Request 1, which gets the client a relay, and reads the fake
+// backend's echo of it.
+func joinBedrock(t *testing.T, client *mctest.RakNetClient) {
+	t.Helper()
+	if err := client.OpenConnection(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Recv(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBedrockIdleReap(t *testing.T) {
+	t.Setenv("BEDROCK_IDLE_S", "1")
+	be, err := mctest.NewBedrockBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	client, _ := startBedrockProxy(t, be.Addr())
+	backend.observe(time.Now(), []byte(be.ServerID), nil)
+
+	joinBedrock(t, client)
+	deadline := time.Now().Add(5 * time.Second)
+	for sessions.activeCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	sessions.mu.Lock()
+	recent := append([]sessionRecord(nil), sessions.recent...)
+	sessions.mu.Unlock()
+	if len(recent) != 1 || recent[0].CloseReason != closeIdleTimeout {
+		t.Fatalf("sessions after going quiet: %+v, want one closed as %s", recent, closeIdleTimeout)
+	}
+
+	// joining again gets a new relay
+	joinBedrock(t, client)
+	if n := sessions.activeCount(); n != 1 {
+		t.Errorf("%d sessions after the client came back, want 1", n)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runtimePeriod is one stretch of backend uptime. End is zero while the backend is still running.
+type runtimePeriod struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end,omitzero"`
+}
+
+type budgetState struct {
+	Periods       []runtimePeriod `json:"periods"`
+	OverrideUntil time.Time       `json:"override_until,omitzero"`
+}
+
+// budgetGuard accumulates backend runtime from wake and stop events and refuses further wakes once the
+// monthly hours or estimated cost budget is used up, unless an operator has granted an override.
+type budgetGuard struct {
+	path       string
+	loc        *time.Location
+	maxHours   float64
+	maxCost    float64
+	hourlyCost float64
+
+	mu    sync.Mutex
+	state budgetState
+
+	wasExceeded atomic.Bool // as of the last updateMetrics, to notice the refusal MOTD changing
+}
+
+var budget *budgetGuard
+
+func newBudgetGuard() *budgetGuard {
+	g := &budgetGuard{
+		path:     statePath("BUDGET_STATE_PATH", "budget.json"),
+		loc:      scheduleLocation(),
+		maxHours: getEnvFloat("BUDGET_MONTHLY_HOURS", 0),
+		maxCost:  getEnvFloat("BUDGET_MONTHLY_COST", 0),
+		// Container Apps consumption pricing for the 3.75 vCPU / 7.5Gi backend:
+		// 3.75 * $0.000024/vCPU-s + 7.5 * $0.000003/GiB-s ≈ $0.405/hour.
+		hourlyCost: getEnvFloat("BUDGET_HOURLY_COST", 0.405),
+	}
+	if err := loadJSONFile(g.path, &g.state); err != nil {
+		slog.Error("budget: failed to load state", "path", g.path, "err", err)
+	}
+	metrics.describe("mcproxy_budget_hours_used", "gauge", "Backend runtime hours used this month.")
+	metrics.describe("mcproxy_budget_cost_used", "gauge", "Estimated backend cost used this month.")
+	metrics.describe("mcproxy_budget_hours_limit", "gauge", "Monthly runtime hours budget (0 = unlimited).")
+	metrics.describe("mcproxy_budget_cost_limit", "gauge", "Monthly cost budget (0 = unlimited).")
+	metrics.describe("mcproxy_budget_exceeded", "gauge", "1 when the monthly budget is used up.")
+	g.updateMetrics()
+	return g
+}
+
+// onWake opens a runtime period when a start is requested. Billing starts with the container, not when
+// Minecraft finishes booting.
+func (g *budgetGuard) onWake(at time.Time) {
+	g.mu.Lock()
+	if n := len(g.state.Periods); n > 0 && g.state.Periods[n-1].End.IsZero() {
+		g.mu.Unlock()
+		return
+	}
+	g.state.Periods = append(g.state.Periods, runtimePeriod{Start: at})
+	g.mu.Unlock()
+	g.save()
+}
+
+// onStop closes the open runtime period, if any.
+func (g *budgetGuard) onStop(at time.Time) {
+	g.mu.Lock()
+	n := len(g.state.Periods)
+	if n == 0 || !g.state.Periods[n-1].End.IsZero() {
+		g.mu.Unlock()
+		return
+	}
+	g.state.Periods[n-1].End = at
+	g.mu.Unlock()
+	g.save()
+}
+
+// onBackendChange follows the backend watcher: a backend found running without a recorded wake (started
+// by hand, or before the proxy restarted) still counts against the budget.
+func (g *budgetGuard) onBackendChange(up bool, at time.Time) {
+	if up {
+		g.onWake(at)
+	} else {
+		g.onStop(at)
+	}
+}
+
+// usage returns the runtime hours and estimated cost accumulated in the month containing now.
+func (g *budgetGuard) usage(now time.Time) (hours, cost float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	local := now.In(g.loc)
+	monthStart := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, g.loc)
+	var total time.Duration
+	for _, p := range g.state.Periods {
+		start, end := p.Start, p.End
+		if end.IsZero() {
+			end = now
+		}
+		if start.Before(monthStart) {
+			start = monthStart
+		}
+		if end.After(start) {
+			total += end.Sub(start)
+		}
+	}
+	hours = total.Hours()
+	return hours, hours * g.hourlyCost
+}
+
+// exceeded reports whether either budget is used up and no override is active.
+func (g *budgetGuard) exceeded(now time.Time) bool {
+	hours, cost := g.usage(now)
+	g.mu.Lock()
+	overridden := now.Before(g.state.OverrideUntil)
+	g.mu.Unlock()
+	if overridden {
+		return false
+	}
+	return (g.maxHours > 0 && hours >= g.maxHours) || (g.maxCost > 0 && cost >= g.maxCost)
+}
+
+// refusal returns the message shown to players while the budget blocks wakes.
+func (g *budgetGuard) refusal() string {
+	hours, cost := g.usage(time.Now())
+	tmpl := getEnv("BUDGET_EXCEEDED_MESSAGE", "§cThis month's server budget is used up ({hours}h, ${cost}).\n§7Ask an admin if you need it started anyway.")
+	return fmtTemplate(tmpl, "hours", fmt.Sprintf("%.1f", hours), "cost", fmt.Sprintf("%.2f", cost))
+}
+
+func (g *budgetGuard) updateMetrics() {
+	hours, cost := g.usage(time.Now())
+	metrics.set("mcproxy_budget_hours_used", hours)
+	metrics.set("mcproxy_budget_cost_used", cost)
+	metrics.set("mcproxy_budget_hours_limit", g.maxHours)
+	metrics.set("mcproxy_budget_cost_limit", g.maxCost)
+	exceeded := 0.0
+	if g.exceeded(time.Now()) {
+		exceeded = 1
+	}
+	if g.wasExceeded.Swap(exceeded == 1) != (exceeded == 1) {
+		invalidateStatus()
+	}
+	metrics.set("mcproxy_budget_exceeded", exceeded)
+}
+
+// run keeps the gauges current while the backend accumulates runtime and drops periods older than
+// three months.
+func (g *budgetGuard) run() {
+	for {
+		g.updateMetrics()
+		g.mu.Lock()
+		cutoff := time.Now().AddDate(0, -3, 0)
+		for len(g.state.Periods) > 0 && !g.state.Periods[0].End.IsZero() && g.state.Periods[0].End.Before(cutoff) {
+			g.state.Periods = g.state.Periods[1:]
+		}
+		g.mu.Unlock()
+		time.Sleep(time.Minute)
+	}
+}
+
+func (g *budgetGuard) save() {
+	g.mu.Lock()
+	state := budgetState{Periods: append([]runtimePeriod(nil), g.state.Periods...), OverrideUntil: g.state.OverrideUntil}
+	g.mu.Unlock()
+	if err := saveJSONFile(g.path, state); err != nil {
+		slog.Error("budget: failed to save state", "path", g.path, "err", err)
+	}
+	g.updateMetrics()
+}
+
+func (g *budgetGuard) handleGet(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	hours, cost := g.usage(now)
+	g.mu.Lock()
+	override := g.state.OverrideUntil
+	g.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"month":          now.In(g.loc).Format("2006-01"),
+		"hours_used":     hours,
+		"cost_used":      cost,
+		"hours_limit":    g.maxHours,
+		"cost_limit":     g.maxCost,
+		"hourly_cost":    g.hourlyCost,
+		"exceeded":       g.exceeded(now),
+		"override_until": override,
+	})
+}
+
+// handleOverride lets an operator allow wakes despite the budget for ?hours=N (default 24). DELETE
+// cancels the override.
+func (g *budgetGuard) handleOverride(w http.ResponseWriter, r *http.Request) {
+	until := time.Time{}
+	if r.Method == http.MethodPost {
+		hours := 24.0
+		if v := r.URL.Query().Get("hours"); v != "" {
+			h, err := strconv.ParseFloat(v, 64)
+			if err != nil || h <= 0 {
+				http.Error(w, "hours must be a positive number", http.StatusBadRequest)
+				return
+			}
+			hours = h
+		}
+		until = time.Now().Add(time.Duration(hours * float64(time.Hour)))
+	}
+	g.mu.Lock()
+	g.state.OverrideUntil = until
+	g.mu.Unlock()
+	g.save()
+	slog.Info("budget: override set", "until", until)
+	g.handleGet(w, r)
+}
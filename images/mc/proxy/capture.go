@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capturer records what clients send and receive before the proxy splices them to the backend, i.e.
+// the unencrypted handshake, status exchange and Login Start, with timings, so a "failed to connect"
+// report can be looked at and replayed (see replay.go). It's opt-in: CAPTURE_FILE names a JSON-lines
+// file, and CAPTURE_IPS / CAPTURE_PLAYERS (comma separated) limit it to some clients; with neither set
+// every connection is captured.
+type capturer struct {
+	ips     []string
+	players []string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+var captures *capturer
+
+func newCapturer() *capturer {
+	path := getEnv("CAPTURE_FILE", "")
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		slog.Error("capture: cannot create directory", "err", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		slog.Error("capture: failed to open (capture disabled)", "path", path, "err", err)
+		return nil
+	}
+	c := &capturer{
+		ips:     splitList(getEnv("CAPTURE_IPS", "")),
+		players: splitList(getEnv("CAPTURE_PLAYERS", "")),
+		file:    f,
+	}
+	slog.Warn("capturing client packets", "path", path, "ips", c.ips, "players", c.players)
+	return c
+}
+
+// captureRecord is one captured connection, one line of CAPTURE_FILE.
+type captureRecord struct {
+	ID        string         `json:"id"`
+	Listener  string         `json:"listener"`
+	Remote    string         `json:"remote"`
+	Start     time.Time      `json:"start"`
+	Username  string         `json:"username,omitempty"`
+	Protocol  int32          `json:"protocol"`
+	NextState int            `json:"next_state"`
+	Events    []captureEvent `json:"events"`
+	EndMs     float64        `json:"end_ms"`
+}
+
+// captureEvent is bytes read from the client ("in"), written to it ("out"), or a note from the proxy
+// about what it did next. TMs is the time since the connection was accepted.
+type captureEvent struct {
+	TMs  float64 `json:"t_ms"`
+	Dir  string  `json:"dir"`
+	Data []byte  `json:"data,omitempty"`
+	Err  string  `json:"err,omitempty"`
+	Note string  `json:"note,omitempty"`
+}
+
+// captureConn records I/O on a client connection until stopped.
+type captureConn struct {
+	net.Conn
+	start time.Time
+
+	mu      sync.Mutex
+	events  []captureEvent
+	stopped time.Time
+}
+
+// wrap starts capturing conn, if capturing is enabled.
+func (c *capturer) wrap(conn net.Conn) net.Conn {
+	if c == nil {
+		return conn
+	}
+	return &captureConn{Conn: conn, start: time.Now()}
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.record("in", b[:n], err)
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.record("out", b[:n], err)
+	return n, err
+}
+
+// record appends an event. Reads happen a VarInt byte at a time, so data arriving within a couple of
+// milliseconds of the previous event in the same direction is merged into it.
+func (c *captureConn) record(dir string, data []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.stopped.IsZero() || (len(data) == 0 && err == nil) {
+		return
+	}
+	t := float64(time.Since(c.start).Microseconds()) / 1000
+	if n := len(c.events); n > 0 {
+		last := &c.events[n-1]
+		if last.Dir == dir && last.Err == "" && last.Note == "" && t-last.TMs < 2 {
+			last.Data = append(last.Data, data...)
+			if err != nil {
+				last.Err = err.Error()
+			}
+			return
+		}
+	}
+	e := captureEvent{TMs: t, Dir: dir, Data: append([]byte(nil), data...)}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	c.events = append(c.events, e)
+}
+
+// captureNote records what the proxy did with conn, if it's being captured.
+func captureNote(conn net.Conn, note string) {
+	c, ok := conn.(*captureConn)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped.IsZero() {
+		c.events = append(c.events, captureEvent{TMs: float64(time.Since(c.start).Microseconds()) / 1000, Dir: "note", Note: note})
+	}
+}
+
+// stopCapture ends recording on conn and returns the connection underneath, so splicing can use the
+// TCP connection directly. Past this point the traffic is compressed and usually encrypted anyway.
+func stopCapture(conn net.Conn) net.Conn {
+	c, ok := conn.(*captureConn)
+	if !ok {
+		return conn
+	}
+	c.mu.Lock()
+	if c.stopped.IsZero() {
+		c.stopped = time.Now()
+	}
+	c.mu.Unlock()
+	return c.Conn
+}
+
+// finish writes conn's capture if the client matches the filters.
+func (c *capturer) finish(conn net.Conn, l *proxyListener, info clientInfo) {
+	cc, ok := conn.(*captureConn)
+	if c == nil || !ok {
+		return
+	}
+	ip := remoteIP(cc.RemoteAddr())
+	cc.mu.Lock()
+	empty := !slices.ContainsFunc(cc.events, func(e captureEvent) bool { return len(e.Data) > 0 })
+	cc.mu.Unlock()
+	if empty {
+		return // a health probe or port scan
+	}
+	if len(c.ips) > 0 || len(c.players) > 0 {
+		byPlayer := slices.ContainsFunc(c.players, func(p string) bool { return strings.EqualFold(p, info.username) })
+		if !slices.Contains(c.ips, ip) && !byPlayer {
+			return
+		}
+	}
+	cc.mu.Lock()
+	end := cc.stopped
+	if end.IsZero() {
+		end = time.Now()
+	}
+	rec := captureRecord{
+		ID:        info.connID,
+		Listener:  l.Name,
+		Remote:    ip,
+		Start:     cc.start,
+		Username:  info.username,
+		Protocol:  info.protocol,
+		NextState: info.nextState,
+		Events:    cc.events,
+		EndMs:     float64(end.Sub(cc.start).Microseconds()) / 1000,
+	}
+	line, _ := json.Marshal(rec)
+	cc.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		slog.Error("capture: write failed", "err", err)
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreykaipov/infra/images/mc/proxy/internal/mctest"
+)
+
+// proxyUnderTest is a proxy listening on loopback, managing a fake backend that a fake ARM starts.
+type proxyUnderTest struct {
+	client  *mctest.Client
+	backend *mctest.Backend
+	arm     *mctest.ARM
+}
+
+// startProxy configures the proxy from the environment (set env vars with t.Setenv before calling it)
+// and serves a single listener in front of a backend in mode.
+func startProxy(t testing.TB, mode mctest.BackendMode) *proxyUnderTest {
+	t.Helper()
+	arm := mctest.NewARM("e2e-token")
+	t.Cleanup(arm.Close)
+	be, err := mctest.NewBackend(mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(be.Close)
+
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "sub")
+	t.Setenv("AZURE_RESOURCE_GROUP", "rg")
+	t.Setenv("AZURE_CONTAINER_APP_NAME", "mc")
+	t.Setenv("AZURE_ARM_ENDPOINT", arm.URL())
+	t.Setenv("AZURE_ARM_TOKEN", "e2e-token")
+	t.Setenv("MOTD", "e2e MOTD")
+	t.Setenv("READY_PROBE_MS", "200")
+	l, err := setupReplay("", be.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	startMu.Lock()
+	lastStartTime, starting = time.Time{}, false
+	startMu.Unlock()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// like acceptLoop, but the test waits for connections to be handled before the next one reinitialises
+	// the state they use
+	var conns sync.WaitGroup
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				handleConnection(c, l)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		conns.Wait()
+	})
+	// wakes outlive the logins that started them
+	t.Cleanup(func() { waitWakes(t) })
+	return &proxyUnderTest{client: mctest.NewClient(ln.Addr().String()), backend: be, arm: arm}
+}
+
+// waitWakes waits for start requests in flight to finish. Players are disconnected before the request
+// goes out, so tests call this before looking at what ARM received.
+func waitWakes(t testing.TB) {
+	t.Helper()
+	if !wakeOps.closeAndWait(10 * time.Second) {
+		t.Error("wake still talking to ARM after 10s")
+	}
+	wakeOps.mu.Lock()
+	wakeOps.closed = false
+	wakeOps.mu.Unlock()
+}
+
+func TestE2EStatus(t *testing.T) {
+	p := startProxy(t, mctest.Healthy)
+	p.client.Protocol = 766
+
+	st, rtt, err := p.client.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Description != "e2e MOTD" {
+		t.Errorf("description %q, want the MOTD", st.Description)
+	}
+	if st.Protocol != 766 || st.Version != "proxy-766" {
+		t.Errorf("version %q protocol %d, want the client's protocol echoed", st.Version, st.Protocol)
+	}
+	if rtt > time.Second {
+		t.Errorf("ping took %v", rtt)
+	}
+	if n := len(p.arm.Starts()); n != 0 {
+		t.Errorf("a status ping sent %d start requests", n)
+	}
+}
+
+func TestE2EFriendlyDisconnects(t *testing.T) {
+	t.Setenv("DISCONNECT_MESSAGE_2", "Starting, try again soon")
+	t.Setenv("SHUTDOWN_MESSAGE", "Proxy restarting")
+	t.Setenv("SHUTDOWN_MOTD", "Restarting")
+
+	t.Run("backend down", func(t *testing.T) {
+		p := startProxy(t, mctest.Down)
+		res, err := p.client.Login("alice", 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(res.Disconnect, "Starting, try again soon\n") {
+			t.Errorf("disconnect %q, want DISCONNECT_MESSAGE_2 and an ETA", res.Disconnect)
+		}
+		waitWakes(t)
+		if got := p.arm.Starts(); !slices.Equal(got, []string{"mc"}) {
+			t.Errorf("ARM starts %q, want one for mc", got)
+		}
+	})
+
+	t.Run("backend not started", func(t *testing.T) {
+		p := startProxy(t, mctest.InstantClose)
+		res, err := p.client.Login("alice", 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(res.Disconnect, "Starting, try again soon\n") {
+			t.Errorf("disconnect %q, want DISCONNECT_MESSAGE_2 and an ETA", res.Disconnect)
+		}
+		waitWakes(t)
+		if n := len(p.arm.Starts()); n != 1 {
+			t.Errorf("%d ARM starts, want 1", n)
+		}
+	})
+
+	t.Run("quiet hours", func(t *testing.T) {
+		// a window two days from now, so wakes are refused today
+		day := time.Now().UTC().AddDate(0, 0, 2).Weekday().String()[:3]
+		t.Setenv("WAKE_WINDOWS", day+" 10:00-11:00")
+		t.Setenv("SCHEDULE_TZ", "UTC")
+		t.Setenv("QUIET_MOTD", "Sleeping until {until}")
+		p := startProxy(t, mctest.Down)
+		res, err := p.client.Login("alice", 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Sleeping until " + day + " 10:00"; res.Disconnect != want {
+			t.Errorf("disconnect %q, want %q", res.Disconnect, want)
+		}
+		st, err := p.client.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(st.Description, "Sleeping until") {
+			t.Errorf("status description %q, want the quiet hours MOTD", st.Description)
+		}
+		waitWakes(t)
+		if n := len(p.arm.Starts()); n != 0 {
+			t.Errorf("%d ARM starts during quiet hours", n)
+		}
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		p := startProxy(t, mctest.Healthy)
+		draining.Store(true)
+		defer draining.Store(false)
+		res, err := p.client.Login("alice", 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Disconnect != "Proxy restarting" {
+			t.Errorf("disconnect %q, want SHUTDOWN_MESSAGE", res.Disconnect)
+		}
+		st, err := p.client.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Description != "Restarting" {
+			t.Errorf("status description %q, want SHUTDOWN_MOTD", st.Description)
+		}
+		if logins := p.backend.Logins(); len(logins) != 0 {
+			t.Errorf("backend saw logins %q while draining", logins)
+		}
+		if got := startAzureContainerApp(context.Background(), wakeEntry{Trigger: "status"}, allPolicies); got != "shutdown" {
+			t.Errorf("wake while draining = %q, want shutdown", got)
+		}
+		if n := len(p.arm.Starts()); n != 0 {
+			t.Errorf("%d ARM starts while draining", n)
+		}
+	})
+}
+
+// TestE2ESingleWake has many players join a sleeping backend at once and checks ARM is asked to start it
+// exactly once, while every player still gets the friendly disconnect.
+func TestE2ESingleWake(t *testing.T) {
+	t.Setenv("DISCONNECT_MESSAGE_2", "Starting")
+	t.Setenv("WAKE_MOTD", "Waking up")
+	p := startProxy(t, mctest.InstantClose)
+	p.arm.Delay = 300 * time.Millisecond // keep the first start in flight while the others arrive
+
+	const players = 20
+	var wg sync.WaitGroup
+	results := make([]mctest.LoginResult, players)
+	errs := make([]error, players)
+	for i := range players {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = p.client.Login("player"+string(rune('a'+i)), 5*time.Second)
+		}()
+	}
+	wg.Wait()
+	for i := range players {
+		if errs[i] != nil {
+			t.Errorf("player %d: %v", i, errs[i])
+		} else if !strings.HasPrefix(results[i].Disconnect, "Starting\n") {
+			t.Errorf("player %d: disconnect %q", i, results[i].Disconnect)
+		}
+	}
+	waitWakes(t)
+	if n := len(p.arm.Starts()); n != 1 {
+		t.Errorf("%d ARM starts for %d concurrent joins, want 1", n, players)
+	}
+	st, err := p.client.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Description != "Waking up" {
+		t.Errorf("status description %q while waking, want WAKE_MOTD", st.Description)
+	}
+}
+
+// TestE2ESplice checks that a login reaches the backend intact and the connection is then relayed both
+// ways, including when the backend is too slow to answer the readiness probe.
+func TestE2ESplice(t *testing.T) {
+	for _, mode := range []mctest.BackendMode{mctest.Healthy, mctest.Slow} {
+		name := map[mctest.BackendMode]string{mctest.Healthy: "healthy", mctest.Slow: "slow"}[mode]
+		t.Run(name, func(t *testing.T) {
+			p := startProxy(t, mode)
+			p.backend.Delay = 500 * time.Millisecond
+			res, err := p.client.Login("alice", 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Conn == nil {
+				t.Fatalf("login was disconnected: %q", res.Disconnect)
+			}
+			defer res.Conn.Close()
+			if got := p.backend.Logins(); !slices.Equal(got, []string{"alice"}) {
+				t.Errorf("backend logins %q, want [alice]", got)
+			}
+
+			msg := []byte("some play packets")
+			if _, err := res.Conn.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			res.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(res.Conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(msg) {
+				t.Errorf("echoed %q, want %q", got, msg)
+			}
+			if n := len(p.arm.Starts()); n != 0 {
+				t.Errorf("%d ARM starts with the backend up", n)
+			}
+
+			res.Conn.Close()
+			deadline := time.Now().Add(5 * time.Second)
+			for sessions.activeCount() > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := sessions.activeCount(); n != 0 {
+				t.Errorf("%d sessions still open after the client left", n)
+			}
+		})
+	}
+}
+
+// TestE2ELegacyPing documents that pre-1.7 server list pings aren't answered: the proxy gives up on
+// the unparsable first packet and closes the connection rather than hanging or forwarding it.
+func TestE2ELegacyPing(t *testing.T) {
+	p := startProxy(t, mctest.Healthy)
+	reply, err := p.client.LegacyPing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 0 {
+		t.Errorf("legacy ping got a reply %q", reply)
+	}
+}
+
+// TestE2ENonLoginsDontWake checks that connections that aren't logins, like legacy pings, scanners and
+// transfers, don't start a sleeping backend.
+func TestE2ENonLoginsDontWake(t *testing.T) {
+	for name, mode := range map[string]mctest.BackendMode{"down": mctest.Down, "instant close": mctest.InstantClose} {
+		t.Run(name, func(t *testing.T) {
+			p := startProxy(t, mode)
+			if _, err := p.client.LegacyPing(); err != nil {
+				t.Fatal(err)
+			}
+			for _, state := range []int32{0, 3} {
+				cn, err := p.client.Dial()
+				if err != nil {
+					t.Fatal(err)
+				}
+				cn.WritePacket(mctest.Handshake(p.client.Protocol, "localhost", 25565, state))
+				cn.LoginStart("alice", [16]byte{})
+				io.Copy(io.Discard, cn)
+				cn.Close()
+			}
+			waitWakes(t)
+			if got := p.arm.Starts(); len(got) != 0 {
+				t.Errorf("ARM starts %q for connections that weren't logins", got)
+			}
+		})
+	}
+}
+
+// TestE2EPingBeforeJoin checks that with PING_FILTER on, a login straight out of nowhere is asked to
+// refresh the server list, and the same login goes through after a status ping.
+func TestE2EPingBeforeJoin(t *testing.T) {
+	t.Setenv("PING_FILTER", "1")
+	t.Setenv("PING_FILTER_MESSAGE", "Refresh your server list")
+	t.Setenv("PING_FILTER_KNOWN_PLAYERS", "bob")
+	p := startProxy(t, mctest.Healthy)
+
+	res, err := p.client.Login("alice", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Disconnect != "Refresh your server list" {
+		t.Fatalf("login without a ping: disconnect %q, want PING_FILTER_MESSAGE", res.Disconnect)
+	}
+	if logins := p.backend.Logins(); len(logins) != 0 {
+		t.Errorf("backend saw logins %q", logins)
+	}
+
+	if _, _, err := p.client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	res, err = p.client.Login("alice", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Conn == nil {
+		t.Fatalf("login after a ping was disconnected: %q", res.Disconnect)
+	}
+	res.Conn.Close()
+
+	pingCheck.mu.Lock() // forget the ping
+	delete(pingCheck.pinged, "127.0.0.1")
+	pingCheck.mu.Unlock()
+	res, err = p.client.Login("bob", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Conn == nil {
+		t.Fatalf("known player was disconnected: %q", res.Disconnect)
+	}
+	res.Conn.Close()
+}
+
+// TestE2EPingFilterTrustedListener checks that a listener without policies doesn't ask for a ping.
+func TestE2EPingFilterTrustedListener(t *testing.T) {
+	t.Setenv("PING_FILTER", "1")
+	t.Setenv("LISTENERS", `[{"name": "ops", "addr": "127.0.0.1:0", "policies": []}]`)
+	p := startProxy(t, mctest.Healthy)
+
+	res, err := p.client.Login("alice", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Conn == nil {
+		t.Fatalf("login on the ops listener was disconnected: %q", res.Disconnect)
+	}
+	res.Conn.Close()
+}
+
+// TestE2EOnlineAuth checks that with ONLINE_AUTH on, a sleeping server is only woken for players the
+// session server vouches for, and that a 1.20.5+ player is held until it's up and transferred back.
+func TestE2EOnlineAuth(t *testing.T) {
+	sessions := mctest.NewSessionServer()
+	t.Cleanup(sessions.Close)
+	t.Setenv("ONLINE_AUTH", "1")
+	t.Setenv("ONLINE_AUTH_SESSION_SERVER", sessions.URL())
+	t.Setenv("ONLINE_AUTH_MESSAGE", "Not verified")
+	t.Setenv("DISCONNECT_MESSAGE_2", "Starting, try again soon")
+	t.Setenv("WAKE_POLL_MS", "100")
+	uuid := [16]byte{0xab, 15: 1}
+
+	login := func(t *testing.T, c *mctest.Client, name string, sessions *mctest.SessionServer) *mctest.Conn {
+		t.Helper()
+		cn, err := c.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cn.Close() })
+		if err := cn.Handshake(2); err != nil {
+			t.Fatal(err)
+		}
+		if err := cn.LoginStart(name, uuid); err != nil {
+			t.Fatal(err)
+		}
+		if err := cn.Encrypt(sessions, name, uuid); err != nil {
+			t.Fatal(err)
+		}
+		return cn
+	}
+	disconnect := func(t *testing.T, cn *mctest.Conn) string {
+		t.Helper()
+		id, body, err := cn.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 0x00 {
+			t.Fatalf("got packet 0x%02x, want Login Disconnect", id)
+		}
+		raw, _, _ := mctest.ReadString(body)
+		return raw
+	}
+
+	t.Run("not joined", func(t *testing.T) {
+		p := startProxy(t, mctest.Down)
+		cn := login(t, p.client, "mallory", nil)
+		if msg := disconnect(t, cn); !strings.Contains(msg, "Not verified") {
+			t.Errorf("disconnect %s, want ONLINE_AUTH_MESSAGE", msg)
+		}
+		waitWakes(t)
+		if got := p.arm.Starts(); len(got) != 0 {
+			t.Errorf("ARM starts %q for an unverified player", got)
+		}
+	})
+
+	t.Run("pre-transfer client", func(t *testing.T) {
+		p := startProxy(t, mctest.Down)
+		p.client.Protocol = 763 // 1.20.1
+		cn := login(t, p.client, "alice", sessions)
+		if msg := disconnect(t, cn); !strings.Contains(msg, "Starting, try again soon") {
+			t.Errorf("disconnect %s, want DISCONNECT_MESSAGE_2", msg)
+		}
+		waitWakes(t)
+		if got := p.arm.Starts(); !slices.Equal(got, []string{"mc"}) {
+			t.Errorf("ARM starts %q, want one for mc", got)
+		}
+	})
+
+	t.Run("start fails while held", func(t *testing.T) {
+		p := startProxy(t, mctest.Down)
+		p.arm.Status = http.StatusForbidden
+		p.client.Timeout = 15 * time.Second
+		cn := login(t, p.client, "alice", sessions)
+		if id, _, err := cn.ReadPacket(); err != nil || id != 0x02 {
+			t.Fatalf("got packet 0x%02x (%v), want Login Success", id, err)
+		}
+		if err := cn.WritePacket([]byte{0x03}); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		id, body, err := cn.ReadPacket()
+		for err == nil && id == 0x04 { // keep-alives
+			id, body, err = cn.ReadPacket()
+		}
+		if err != nil || id != 0x02 || !bytes.Contains(body, []byte("Starting, try again soon")) {
+			t.Fatalf("got packet 0x%02x %q (%v), want a configuration Disconnect", id, body, err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("held for %v after the start failed", d)
+		}
+	})
+
+	t.Run("held and transferred", func(t *testing.T) {
+		p := startProxy(t, mctest.Down)
+		p.arm.OnStart = func(string) { p.backend.SetMode(mctest.Healthy) }
+		p.client.Timeout = 15 * time.Second
+		cn := login(t, p.client, "alice", sessions)
+		id, body, err := cn.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 0x02 || !bytes.Equal(body[:16], uuid[:]) {
+			t.Fatalf("got packet 0x%02x %x, want Login Success for the verified UUID", id, body)
+		}
+		if name, _, _ := mctest.ReadString(body[16:]); name != "alice" {
+			t.Errorf("Login Success for %q", name)
+		}
+		if err := cn.WritePacket([]byte{0x03}); err != nil { // Login Acknowledged
+			t.Fatal(err)
+		}
+		for id != 0x0B {
+			if id, body, err = cn.ReadPacket(); err != nil {
+				t.Fatalf("waiting for Transfer: %v", err)
+			}
+		}
+		if host, rest, _ := mctest.ReadString(body); host != "localhost" || !bytes.Equal(rest, mctest.AppendVarInt(nil, 25565)) {
+			t.Errorf("transfer to %q %x, want the handshake's address", host, rest)
+		}
+		waitWakes(t)
+		if got := p.arm.Starts(); !slices.Equal(got, []string{"mc"}) {
+			t.Errorf("ARM starts %q, want one for mc", got)
+		}
+
+		// the client comes back as a transfer, which the backend sees as a login
+		back, err := p.client.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer back.Close()
+		if err := back.WritePacket(mctest.Handshake(p.client.Protocol, "localhost", 25565, 3)); err != nil {
+			t.Fatal(err)
+		}
+		if err := back.LoginStart("alice", uuid); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); !slices.Equal(p.backend.Logins(), []string{"alice"}); time.Sleep(50 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("backend logins %q, want the transferred player", p.backend.Logins())
+			}
+		}
+	})
+}
+
+// TestE2EStartConflict checks that a start ARM answers with 409 (already running) isn't tracked or
+// charged as a wake.
+func TestE2EStartConflict(t *testing.T) {
+	p := startProxy(t, mctest.Down)
+	p.arm.Status = http.StatusConflict
+	if _, err := p.client.Login("alice", 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitWakes(t)
+	if got := p.arm.Starts(); !slices.Equal(got, []string{"mc"}) {
+		t.Fatalf("ARM starts %q, want one for mc", got)
+	}
+	if inFlight, _, _ := wakes.progress(); inFlight {
+		t.Error("wake in flight for a backend that was already running")
+	}
+	budget.mu.Lock()
+	periods := len(budget.state.Periods)
+	budget.mu.Unlock()
+	ledger.mu.Lock()
+	entries := len(ledger.entries)
+	ledger.mu.Unlock()
+	if periods != 0 || entries != 0 {
+		t.Errorf("%d runtime periods and %d ledger entries, want none", periods, entries)
+	}
+}
+
+// TestE2EWakeTimeout checks that a backend that never becomes ready is stopped, and only then stops
+// counting against the budget.
+func TestE2EWakeTimeout(t *testing.T) {
+	t.Setenv("WAKE_READY_TIMEOUT_S", "1")
+	t.Setenv("WAKE_POLL_MS", "100")
+	p := startProxy(t, mctest.Down)
+	if _, err := p.client.Login("alice", 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitWakes(t)
+	closed := func() bool {
+		budget.mu.Lock()
+		defer budget.mu.Unlock()
+		n := len(budget.state.Periods)
+		return n > 0 && !budget.state.Periods[n-1].End.IsZero()
+	}
+	for deadline := time.Now().Add(5 * time.Second); !closed(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("runtime period still open after the wake timed out")
+		}
+	}
+	if got := p.arm.Stops(); !slices.Equal(got, []string{"mc"}) {
+		t.Errorf("ARM stops %q, want one for mc before the runtime period closed", got)
+	}
+}
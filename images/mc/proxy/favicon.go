@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	_ "image/gif"
+	_ "image/jpeg"
+
+	"golang.org/x/image/draw"
+)
+
+// faviconSize is the only icon size the client shows; anything else comes out broken.
+const faviconSize = 64
+
+// faviconSet holds server list icons, as data URLs, for each backend state: "sleeping", "starting"
+// (a wake is in flight), "online", and "default" for states without their own. A state can have
+// several icons, from a directory, which rotate from one ping to the next.
+type faviconSet map[string][]string
+
+var faviconStates = []string{"default", "sleeping", "starting", "online"}
+
+// favicons are the icons from FAVICON_BASE64 or FAVICON_PATH (the default) and FAVICON_SLEEPING_PATH,
+// FAVICON_STARTING_PATH and FAVICON_ONLINE_PATH. Listeners can configure their own instead.
+var favicons faviconSet
+
+func loadFavicons() faviconSet {
+	set := faviconSet{}
+	if fb := getEnv("FAVICON_BASE64", ""); fb != "" {
+		// if it already includes a data: prefix, drop it; the image is re-encoded either way
+		if _, b64, ok := strings.Cut(fb, ";base64,"); ok {
+			fb = b64
+		}
+		data, err := base64.StdEncoding.DecodeString(fb)
+		if err == nil {
+			var icon string
+			if icon, err = faviconDataURL(data, "FAVICON_BASE64"); err == nil {
+				set["default"] = []string{icon}
+			}
+		}
+		if err != nil {
+			slog.Error("invalid FAVICON_BASE64", "err", err)
+		}
+	} else {
+		set.load("default", getEnv("FAVICON_PATH", ""))
+	}
+	for _, state := range faviconStates[1:] {
+		set.load(state, getEnv("FAVICON_"+strings.ToUpper(state)+"_PATH", ""))
+	}
+	return set
+}
+
+// load sets state's icons from path, a file or a directory of them. Failures are logged and leave the
+// state without icons of its own.
+func (s faviconSet) load(state, path string) {
+	if path == "" {
+		return
+	}
+	icons, err := loadFaviconPath(path)
+	if err != nil {
+		slog.Error("failed to load favicon", "state", state, "path", path, "err", err)
+		return
+	}
+	s[state] = icons
+}
+
+// forState returns the icons to show in state: its own, or else sleeping's for starting, or else the
+// default ones.
+func (s faviconSet) forState(state string) []string {
+	if icons := s[state]; len(icons) > 0 {
+		return icons
+	}
+	if icons := s["sleeping"]; state == "starting" && len(icons) > 0 {
+		return icons
+	}
+	return s["default"]
+}
+
+// loadFaviconPath loads a single icon, or every PNG, JPEG and GIF in a directory (in name order).
+// Unusable files in a directory are skipped with a warning.
+func loadFaviconPath(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		icon, err := faviconDataURL(data, path)
+		if err != nil {
+			return nil, err
+		}
+		return []string{icon}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var icons []string
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if !e.Type().IsRegular() || !slices.Contains([]string{".png", ".jpg", ".jpeg", ".gif"}, ext) {
+			continue
+		}
+		file := filepath.Join(path, e.Name())
+		data, err := os.ReadFile(file)
+		if err == nil {
+			var icon string
+			if icon, err = faviconDataURL(data, file); err == nil {
+				icons = append(icons, icon)
+				continue
+			}
+		}
+		slog.Warn("skipping favicon", "path", file, "err", err)
+	}
+	if len(icons) == 0 {
+		return nil, fmt.Errorf("no usable images in %s", path)
+	}
+	return icons, nil
+}
+
+// faviconDataURL validates an image and returns it as a PNG data URL. A 64x64 PNG is used as is;
+// anything else is scaled to fit 64x64, keeping its aspect ratio, and re-encoded as PNG.
+func faviconDataURL(data []byte, name string) (string, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a PNG, JPEG or GIF image: %w", name, err)
+	}
+	b := img.Bounds()
+	if format != "png" || b.Dx() != faviconSize || b.Dy() != faviconSize {
+		w, h := faviconSize, faviconSize
+		if b.Dx() > b.Dy() {
+			h = max(1, faviconSize*b.Dy()/b.Dx())
+		} else if b.Dy() > b.Dx() {
+			w = max(1, faviconSize*b.Dx()/b.Dy())
+		}
+		dst := image.NewNRGBA(image.Rect(0, 0, faviconSize, faviconSize))
+		at := image.Pt((faviconSize-w)/2, (faviconSize-h)/2)
+		draw.CatmullRom.Scale(dst, image.Rectangle{Min: at, Max: at.Add(image.Pt(w, h))}, img, b, draw.Over, nil)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, dst); err != nil {
+			return "", err
+		}
+		slog.Info("favicon resized", "path", name, "format", format, "width", b.Dx(), "height", b.Dy())
+		data = buf.Bytes()
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data), nil
+}
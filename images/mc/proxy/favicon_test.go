@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFaviconDataURL(t *testing.T) {
+	decode := func(t *testing.T, url string) (image.Image, string) {
+		t.Helper()
+		b64, ok := strings.CutPrefix(url, "data:image/png;base64,")
+		if !ok {
+			t.Fatalf("not a PNG data URL: %.40s", url)
+		}
+		data, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img, format
+	}
+
+	t.Run("64x64 PNG kept as is", func(t *testing.T) {
+		data := encodePNG(t, 64, 64, color.NRGBA{R: 255, A: 255})
+		url, err := faviconDataURL(data, "ok.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if url != "data:image/png;base64,"+base64.StdEncoding.EncodeToString(data) {
+			t.Error("a valid icon was re-encoded")
+		}
+	})
+
+	t.Run("wide JPEG resized", func(t *testing.T) {
+		var buf bytes.Buffer
+		src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+		for i := range src.Pix {
+			src.Pix[i] = 0xff
+		}
+		if err := jpeg.Encode(&buf, src, nil); err != nil {
+			t.Fatal(err)
+		}
+		url, err := faviconDataURL(buf.Bytes(), "wide.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, format := decode(t, url)
+		if format != "png" || img.Bounds() != image.Rect(0, 0, 64, 64) {
+			t.Fatalf("got a %v %s, want a 64x64 png", img.Bounds(), format)
+		}
+		// letterboxed: transparent above and below, opaque in the middle
+		if _, _, _, a := img.At(32, 2).RGBA(); a != 0 {
+			t.Error("top edge isn't transparent")
+		}
+		if _, _, _, a := img.At(32, 32).RGBA(); a == 0 {
+			t.Error("middle is transparent")
+		}
+	})
+
+	t.Run("not an image", func(t *testing.T) {
+		if _, err := faviconDataURL([]byte("<svg/>"), "icon.svg"); err == nil {
+			t.Error("accepted an SVG")
+		}
+	})
+}
+
+// TestFaviconRotation checks that a directory of icons rotates from one status response to the next and
+// that a listener shows its sleeping icon while the backend is down.
+func TestFaviconRotation(t *testing.T) {
+	dir := t.TempDir()
+	for i, c := range []color.NRGBA{{R: 255, A: 255}, {G: 255, A: 255}} {
+		os.WriteFile(filepath.Join(dir, string(rune('a'+i))+".png"), encodePNG(t, 64, 64, c), 0o644)
+	}
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0o644)
+	sleeping := filepath.Join(t.TempDir(), "sleeping.png")
+	os.WriteFile(sleeping, encodePNG(t, 32, 32, color.NRGBA{B: 255, A: 255}), 0o644)
+
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("FAVICON_PATH", dir)
+	l, err := setupReplay("", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second, third := l.status.response(l, 767), l.status.response(l, 767), l.status.response(l, 767)
+	if bytes.Equal(first, second) || !bytes.Equal(first, third) {
+		t.Error("two icons in FAVICON_PATH don't alternate")
+	}
+
+	t.Setenv("FAVICON_SLEEPING_PATH", sleeping)
+	l, err = setupReplay("", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if icons := l.favicons(); len(icons) != 1 || icons[0] != favicons["sleeping"][0] {
+		t.Errorf("backend down: got %d icons, want the sleeping one", len(icons))
+	}
+}
+
+func encodePNG(t *testing.T, w, h int, c color.NRGBA) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
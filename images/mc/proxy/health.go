@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// listening counts the Minecraft listeners that are bound and accepting; the proxy is listening while
+// any of them is.
+var listening atomic.Int32
+
+// startHealthServer serves /healthz and /readyz on HEALTH_ADDR for container probes. They're kept off
+// the game port so probes don't have to be told apart from players, and off the admin port so they
+// stay reachable without exposing the operator API.
+//
+// /healthz fails only if the listeners are all gone, which a restart would fix. /readyz also fails while
+// draining. Neither depends on the backend: a sleeping backend is the proxy's normal state.
+func startHealthServer(addr string) {
+	if addr == "" {
+		return
+	}
+	report := func(w http.ResponseWriter, ok bool) {
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"ok":         ok,
+			"listening":  listening.Load() > 0,
+			"draining":   draining.Load(),
+			"backend_up": backend.isUp(),
+			"sessions":   sessions.activeCount(),
+		})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		report(w, listening.Load() > 0 || draining.Load())
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		report(w, listening.Load() > 0 && !draining.Load())
+	})
+	go func() {
+		slog.Info("health server listening", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("health server failed", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,81 @@
+package mctest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ARM is a fake Azure Resource Manager endpoint that accepts container app start and stop requests
+// (POST .../providers/Microsoft.App/containerApps/{name}/start or /stop) and counts them.
+type ARM struct {
+	Token   string        // bearer token requests must carry; empty accepts any
+	Delay   time.Duration // before answering, e.g. to widen the window for racing starts
+	Status  int           // status code for starts, 202 if zero
+	OnStart func(app string)
+
+	srv    *httptest.Server
+	mu     sync.Mutex
+	starts []string
+	stops  []string
+}
+
+// NewARM starts a fake ARM endpoint on loopback.
+func NewARM(token string) *ARM {
+	a := &ARM{Token: token}
+	a.srv = httptest.NewServer(http.HandlerFunc(a.handle))
+	return a
+}
+
+// URL is the endpoint's base URL, to use in place of https://management.azure.com.
+func (a *ARM) URL() string { return a.srv.URL }
+
+// Starts returns the container app names of the start requests received so far.
+func (a *ARM) Starts() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.starts...)
+}
+
+// Stops returns the container app names of the stop requests received so far.
+func (a *ARM) Stops() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.stops...)
+}
+
+func (a *ARM) Close() { a.srv.Close() }
+
+func (a *ARM) handle(w http.ResponseWriter, r *http.Request) {
+	if a.Token != "" && r.Header.Get("Authorization") != "Bearer "+a.Token {
+		http.Error(w, `{"error":{"code":"InvalidAuthenticationToken"}}`, http.StatusUnauthorized)
+		return
+	}
+	_, app, ok := strings.Cut(r.URL.Path, "/providers/Microsoft.App/containerApps/")
+	if stopped, isStop := strings.CutSuffix(app, "/stop"); r.Method == http.MethodPost && ok && isStop {
+		a.mu.Lock()
+		a.stops = append(a.stops, stopped)
+		a.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	app, isStart := strings.CutSuffix(app, "/start")
+	if r.Method != http.MethodPost || !ok || !isStart {
+		http.NotFound(w, r)
+		return
+	}
+	a.mu.Lock()
+	a.starts = append(a.starts, app)
+	a.mu.Unlock()
+	time.Sleep(a.Delay)
+	if a.OnStart != nil {
+		a.OnStart(app)
+	}
+	status := a.Status
+	if status == 0 {
+		status = http.StatusAccepted
+	}
+	w.WriteHeader(status)
+}
@@ -0,0 +1,188 @@
+package mctest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// BackendMode is how a Backend treats connections.
+type BackendMode int
+
+const (
+	// Healthy answers status pings and, after Login Start, echoes whatever the client sends.
+	Healthy BackendMode = iota
+	// Down isn't listening: connections are refused, like a container app scaled to zero.
+	Down
+	// InstantClose accepts connections and closes them straight away, like a container whose server
+	// hasn't started yet.
+	InstantClose
+	// Slow is Healthy, but waits Delay before every response.
+	Slow
+)
+
+// Backend is a fake Minecraft server.
+type Backend struct {
+	Delay time.Duration // response delay in Slow mode
+	MOTD  string
+
+	mu     sync.Mutex
+	mode   BackendMode
+	addr   string
+	ln     net.Listener
+	conns  map[net.Conn]bool
+	logins []string
+}
+
+// NewBackend starts a backend on a loopback port in mode.
+func NewBackend(mode BackendMode) (*Backend, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Backend{Delay: 2 * time.Second, MOTD: "fake backend", addr: ln.Addr().String(), conns: map[net.Conn]bool{}}
+	b.ln = ln
+	go b.serve(ln)
+	if err := b.SetMode(mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Addr is the backend's address. It stays the same across mode changes.
+func (b *Backend) Addr() string { return b.addr }
+
+// SetMode changes how new connections are treated. Going Down stops listening and drops open
+// connections; leaving Down listens again on the same port.
+func (b *Backend) SetMode(mode BackendMode) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mode = mode
+	switch {
+	case mode == Down && b.ln != nil:
+		b.ln.Close()
+		b.ln = nil
+		for c := range b.conns {
+			c.Close()
+		}
+	case mode != Down && b.ln == nil:
+		ln, err := net.Listen("tcp", b.addr)
+		if err != nil {
+			return err
+		}
+		b.ln = ln
+		go b.serve(ln)
+	}
+	return nil
+}
+
+// Logins returns the names from every Login Start the backend has received, in order.
+func (b *Backend) Logins() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.logins...)
+}
+
+// Close stops the backend and drops its connections.
+func (b *Backend) Close() {
+	b.SetMode(Down)
+}
+
+func (b *Backend) serve(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		mode := b.mode
+		if mode == InstantClose {
+			b.mu.Unlock()
+			c.Close()
+			continue
+		}
+		b.conns[c] = true
+		b.mu.Unlock()
+		go func() {
+			defer func() {
+				b.mu.Lock()
+				delete(b.conns, c)
+				b.mu.Unlock()
+				c.Close()
+			}()
+			b.handle(c, mode)
+		}()
+	}
+}
+
+func (b *Backend) handle(c net.Conn, mode BackendMode) {
+	wait := func() {
+		if mode == Slow {
+			time.Sleep(b.Delay)
+		}
+	}
+	r := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	id, body, err := ReadPacket(r)
+	if err != nil || id != 0x00 {
+		return
+	}
+	protocol, nextState, err := parseHandshake(body)
+	if err != nil {
+		return
+	}
+	switch nextState {
+	case 1:
+		if _, _, err := ReadPacket(r); err != nil { // Status Request
+			return
+		}
+		wait()
+		status := fmt.Sprintf(`{"version":{"name":"fake","protocol":%d},"players":{"max":20,"online":0},"description":{"text":%q}}`, protocol, b.MOTD)
+		if _, err := c.Write(Frame(AppendString([]byte{0x00}, status))); err != nil {
+			return
+		}
+		id, body, err := ReadPacket(r)
+		if err != nil || id != 0x01 {
+			return
+		}
+		wait()
+		c.Write(Frame(append([]byte{0x01}, body...)))
+	case 2:
+		id, body, err := ReadPacket(r)
+		if err != nil || id != 0x00 {
+			return
+		}
+		name, _, err := ReadString(body)
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.logins = append(b.logins, name)
+		b.mu.Unlock()
+		wait()
+		c.SetReadDeadline(time.Time{})
+		io.Copy(c, r)
+	}
+}
+
+// parseHandshake returns a handshake body's protocol version and next state.
+func parseHandshake(body []byte) (protocol, nextState int32, err error) {
+	br := &sliceReader{b: body}
+	if protocol, err = ReadVarInt(br); err != nil {
+		return 0, 0, err
+	}
+	_, rest, err := ReadString(body[br.i:])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(rest) < 3 {
+		return 0, 0, errors.New("short handshake")
+	}
+	nextState, err = ReadVarInt(&sliceReader{b: rest[2:]}) // after the port
+	return protocol, nextState, err
+}
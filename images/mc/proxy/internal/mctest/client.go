@@ -0,0 +1,283 @@
+package mctest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+	"unicode/utf16"
+)
+
+// DefaultProtocol is the protocol version clients announce unless told otherwise (1.21.1).
+const DefaultProtocol = 767
+
+// Client is a scriptable Minecraft client. The convenience methods (Status, Ping, Login, LegacyPing)
+// each use a fresh connection; Dial gives a Conn for scripting an exchange packet by packet.
+type Client struct {
+	Addr     string
+	Protocol int32
+	Host     string // server address sent in the handshake
+	Port     uint16
+	Timeout  time.Duration // for every read and write
+}
+
+func NewClient(addr string) *Client {
+	return &Client{Addr: addr, Protocol: DefaultProtocol, Host: "localhost", Port: 25565, Timeout: 5 * time.Second}
+}
+
+// Conn is an open client connection.
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+	c *Client
+}
+
+func (c *Client) Dial() (*Conn, error) {
+	nc, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: nc, r: bufio.NewReader(nc), c: c}, nil
+}
+
+// WritePacket frames and sends a packet (ID and body).
+func (cn *Conn) WritePacket(packet []byte) error {
+	cn.SetWriteDeadline(time.Now().Add(cn.c.Timeout))
+	_, err := cn.Write(Frame(packet))
+	return err
+}
+
+// ReadPacket reads the next packet.
+func (cn *Conn) ReadPacket() (id int32, body []byte, err error) {
+	cn.SetReadDeadline(time.Now().Add(cn.c.Timeout))
+	return ReadPacket(cn.r)
+}
+
+// Read reads raw bytes, e.g. once the connection is spliced to the backend. It reads through the
+// packet reader's buffer so nothing already received is skipped.
+func (cn *Conn) Read(b []byte) (int, error) {
+	return cn.r.Read(b)
+}
+
+func (cn *Conn) Handshake(nextState int32) error {
+	return cn.WritePacket(Handshake(cn.c.Protocol, cn.c.Host, cn.c.Port, nextState))
+}
+
+// LoginStart sends Login Start with name and, for clients new enough to send one, uuid.
+func (cn *Conn) LoginStart(name string, uuid [16]byte) error {
+	p := AppendString([]byte{0x00}, name)
+	switch {
+	case cn.c.Protocol >= 764: // 1.20.2+: UUID always present
+		p = append(p, uuid[:]...)
+	case cn.c.Protocol >= 761: // 1.19.3+: optional UUID
+		p = append(append(p, 1), uuid[:]...)
+	case cn.c.Protocol == 760: // 1.19.1: optional signature data, then optional UUID
+		p = append(p, 0, 1)
+		p = append(p, uuid[:]...)
+	case cn.c.Protocol == 759: // 1.19: optional signature data
+		p = append(p, 0)
+	}
+	return cn.WritePacket(p)
+}
+
+// Status is a decoded status response.
+type Status struct {
+	Raw         string
+	Description string
+	Online, Max int
+	Sample      []string
+	Version     string
+	Protocol    int32
+	Favicon     string
+}
+
+// ReadStatus sends a Status Request and reads the response.
+func (cn *Conn) ReadStatus() (Status, error) {
+	if err := cn.WritePacket([]byte{0x00}); err != nil {
+		return Status{}, err
+	}
+	id, body, err := cn.ReadPacket()
+	if err != nil {
+		return Status{}, err
+	}
+	if id != 0x00 {
+		return Status{}, fmt.Errorf("status response has packet id 0x%02x", id)
+	}
+	raw, _, err := ReadString(body)
+	if err != nil {
+		return Status{}, err
+	}
+	var v struct {
+		Description json.RawMessage `json:"description"`
+		Players     struct {
+			Max    int `json:"max"`
+			Online int `json:"online"`
+			Sample []struct {
+				Name string `json:"name"`
+			} `json:"sample"`
+		} `json:"players"`
+		Version struct {
+			Name     string `json:"name"`
+			Protocol int32  `json:"protocol"`
+		} `json:"version"`
+		Favicon string `json:"favicon"`
+	}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return Status{}, fmt.Errorf("status JSON: %w", err)
+	}
+	st := Status{Raw: raw, Online: v.Players.Online, Max: v.Players.Max, Version: v.Version.Name,
+		Protocol: v.Version.Protocol, Favicon: v.Favicon, Description: textOf(v.Description)}
+	for _, p := range v.Players.Sample {
+		st.Sample = append(st.Sample, p.Name)
+	}
+	return st, nil
+}
+
+// PingPong sends a Ping Request with payload and waits for the matching Pong.
+func (cn *Conn) PingPong(payload int64) error {
+	if err := cn.WritePacket(binary.BigEndian.AppendUint64([]byte{0x01}, uint64(payload))); err != nil {
+		return err
+	}
+	id, body, err := cn.ReadPacket()
+	if err != nil {
+		return err
+	}
+	if id != 0x01 || len(body) != 8 || int64(binary.BigEndian.Uint64(body)) != payload {
+		return fmt.Errorf("bad pong: id 0x%02x body %x", id, body)
+	}
+	return nil
+}
+
+// Status does a server list status request.
+func (c *Client) Status() (Status, error) {
+	cn, err := c.Dial()
+	if err != nil {
+		return Status{}, err
+	}
+	defer cn.Close()
+	if err := cn.Handshake(1); err != nil {
+		return Status{}, err
+	}
+	return cn.ReadStatus()
+}
+
+// Ping does a full server list exchange, status then ping-pong, the way the client's server list does.
+func (c *Client) Ping() (Status, time.Duration, error) {
+	cn, err := c.Dial()
+	if err != nil {
+		return Status{}, 0, err
+	}
+	defer cn.Close()
+	if err := cn.Handshake(1); err != nil {
+		return Status{}, 0, err
+	}
+	st, err := cn.ReadStatus()
+	if err != nil {
+		return st, 0, err
+	}
+	start := time.Now()
+	err = cn.PingPong(start.UnixMilli())
+	return st, time.Since(start), err
+}
+
+// LoginResult is how the proxy treated a login: either it disconnected the client with a message, or it
+// handed the connection to the backend, in which case Conn is left open for the test to use.
+type LoginResult struct {
+	Disconnect string // the Login Disconnect text, if the proxy sent one
+	Conn       *Conn  // the spliced connection, if it wasn't disconnected
+}
+
+// Login sends a handshake and Login Start. If the proxy answers within wait with a Login Disconnect,
+// that's the result; if it doesn't answer, the connection is assumed to have been handed to the backend.
+func (c *Client) Login(name string, wait time.Duration) (LoginResult, error) {
+	cn, err := c.Dial()
+	if err != nil {
+		return LoginResult{}, err
+	}
+	if err := cn.Handshake(2); err != nil {
+		cn.Close()
+		return LoginResult{}, err
+	}
+	if err := cn.LoginStart(name, [16]byte{}); err != nil {
+		cn.Close()
+		return LoginResult{}, err
+	}
+	cn.SetReadDeadline(time.Now().Add(wait))
+	id, body, err := ReadPacket(cn.r)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		cn.SetReadDeadline(time.Time{})
+		return LoginResult{Conn: cn}, nil
+	}
+	defer cn.Close()
+	if err != nil {
+		return LoginResult{}, err
+	}
+	if id != 0x00 {
+		return LoginResult{}, fmt.Errorf("unexpected login packet 0x%02x", id)
+	}
+	raw, _, err := ReadString(body)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	return LoginResult{Disconnect: textOf(json.RawMessage(raw))}, nil
+}
+
+// LegacyPing sends a pre-1.7 (1.6) server list ping and returns the raw reply, which is empty if the
+// server closed the connection without answering.
+func (c *Client) LegacyPing() ([]byte, error) {
+	cn, err := c.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer cn.Close()
+	host := utf16.Encode([]rune(c.Host))
+	p := []byte{0xFE, 0x01, 0xFA}
+	p = appendUTF16(p, utf16.Encode([]rune("MC|PingHost")))
+	p = binary.BigEndian.AppendUint16(p, uint16(7+2*len(host)))
+	p = append(p, 74) // protocol 1.6.4
+	p = appendUTF16(p, host)
+	p = binary.BigEndian.AppendUint32(p, uint32(c.Port))
+	cn.SetDeadline(time.Now().Add(c.Timeout))
+	if _, err := cn.Conn.Write(p); err != nil {
+		return nil, err
+	}
+	var out []byte
+	buf := make([]byte, 512)
+	for {
+		n, err := cn.Read(buf)
+		out = append(out, buf[:n]...)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return out, err
+			}
+			return out, nil
+		}
+	}
+}
+
+func appendUTF16(b []byte, s []uint16) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	for _, c := range s {
+		b = binary.BigEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+// textOf flattens a chat component (a string or {"text":..., "extra":[...]}) to plain text.
+func textOf(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var c struct {
+		Text  string            `json:"text"`
+		Extra []json.RawMessage `json:"extra"`
+	}
+	json.Unmarshal(raw, &c)
+	for _, e := range c.Extra {
+		c.Text += textOf(e)
+	}
+	return c.Text
+}
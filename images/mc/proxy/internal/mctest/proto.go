@@ -0,0 +1,104 @@
+// Package mctest has fakes for testing the proxy end to end without a network: a scriptable Minecraft
+// client, a backend server that can be told to misbehave, and an ARM endpoint that counts start
+// requests. Everything listens on loopback.
+package mctest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// AppendVarInt appends v in the protocol's VarInt encoding.
+func AppendVarInt(b []byte, v int32) []byte {
+	u := uint32(v)
+	for u >= 0x80 {
+		b = append(b, byte(u)|0x80)
+		u >>= 7
+	}
+	return append(b, byte(u))
+}
+
+// ReadVarInt reads a VarInt from r.
+func ReadVarInt(r io.ByteReader) (int32, error) {
+	var v uint32
+	for i := 0; i < 5; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint32(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			return int32(v), nil
+		}
+	}
+	return 0, errors.New("VarInt too big")
+}
+
+// AppendString appends a VarInt length-prefixed string.
+func AppendString(b []byte, s string) []byte {
+	return append(AppendVarInt(b, int32(len(s))), s...)
+}
+
+// Frame prefixes a packet (ID and body) with its length.
+func Frame(packet []byte) []byte {
+	return append(AppendVarInt(nil, int32(len(packet))), packet...)
+}
+
+// ReadPacket reads one length-prefixed packet and returns its ID and body.
+func ReadPacket(r *bufio.Reader) (id int32, body []byte, err error) {
+	n, err := ReadVarInt(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n <= 0 || n > 2097151 {
+		return 0, nil, fmt.Errorf("invalid packet length %d", n)
+	}
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+	br := &sliceReader{b: packet}
+	id, err = ReadVarInt(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, packet[br.i:], nil
+}
+
+// ReadString reads a VarInt length-prefixed string from the start of b and returns it and the rest.
+func ReadString(b []byte) (string, []byte, error) {
+	br := &sliceReader{b: b}
+	n, err := ReadVarInt(br)
+	if err != nil {
+		return "", nil, err
+	}
+	if n < 0 || br.i+int(n) > len(b) {
+		return "", nil, errors.New("string runs past the packet")
+	}
+	return string(b[br.i : br.i+int(n)]), b[br.i+int(n):], nil
+}
+
+// Handshake builds a handshake packet.
+func Handshake(protocol int32, host string, port uint16, nextState int32) []byte {
+	p := AppendVarInt([]byte{0x00}, protocol)
+	p = AppendString(p, host)
+	p = binary.BigEndian.AppendUint16(p, port)
+	return AppendVarInt(p, nextState)
+}
+
+type sliceReader struct {
+	b []byte
+	i int
+}
+
+func (r *sliceReader) ReadByte() (byte, error) {
+	if r.i >= len(r.b) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c := r.b[r.i]
+	r.i++
+	return c, nil
+}
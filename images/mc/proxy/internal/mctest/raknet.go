@@ -0,0 +1,127 @@
+package mctest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RakNet message IDs the fakes use, and the "offline message" magic every unconnected packet carries.
+const (
+	raknetUnconnectedPing    = 0x01
+	raknetOpenConnectionReq1 = 0x05
+	raknetUnconnectedPong    = 0x1C
+)
+
+var raknetMagic = []byte{0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe, 0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78}
+
+// BedrockBackend is a fake Bedrock server: it answers Unconnected Pings with ServerID and echoes every
+// other datagram back to its sender.
+type BedrockBackend struct {
+	ServerID string
+
+	conn net.PacketConn
+}
+
+// NewBedrockBackend starts a Bedrock backend on a loopback UDP port.
+func NewBedrockBackend() (*BedrockBackend, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &BedrockBackend{ServerID: "MCPE;fake bedrock backend;800;1.21.80;0;10;1;world;Survival;1;19132;19132;", conn: conn}
+	go b.serve()
+	return b, nil
+}
+
+// Addr is the backend's address.
+func (b *BedrockBackend) Addr() string { return b.conn.LocalAddr().String() }
+
+func (b *BedrockBackend) Close() { b.conn.Close() }
+
+func (b *BedrockBackend) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n >= 9 && buf[0] == raknetUnconnectedPing {
+			b.conn.WriteTo(Pong(buf[1:9], 1, b.ServerID), addr)
+			continue
+		}
+		b.conn.WriteTo(buf[:n], addr)
+	}
+}
+
+// Pong builds an Unconnected Pong echoing a ping's timestamp.
+func Pong(pingTime []byte, guid uint64, serverID string) []byte {
+	out := append([]byte{raknetUnconnectedPong}, pingTime...)
+	out = binary.BigEndian.AppendUint64(out, guid)
+	out = append(out, raknetMagic...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(serverID)))
+	return append(out, serverID...)
+}
+
+// RakNetClient is a fake Bedrock client: a UDP socket that speaks just enough RakNet to list a server
+// and start joining it.
+type RakNetClient struct {
+	*net.UDPConn
+}
+
+// DialRakNet opens a client socket to addr.
+func DialRakNet(addr string) (*RakNetClient, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &RakNetClient{conn}, nil
+}
+
+// Ping sends an Unconnected Ping and returns the pong's server ID string.
+func (c *RakNetClient) Ping(timeout time.Duration) (string, error) {
+	ping := binary.BigEndian.AppendUint64([]byte{raknetUnconnectedPing}, uint64(time.Now().UnixMilli()))
+	ping = append(ping, raknetMagic...)
+	ping = binary.BigEndian.AppendUint64(ping, 2) // client GUID
+	if _, err := c.Write(ping); err != nil {
+		return "", err
+	}
+	pong, err := c.Recv(timeout)
+	if err != nil {
+		return "", err
+	}
+	if len(pong) < 35 || pong[0] != raknetUnconnectedPong || !bytes.Equal(pong[17:33], raknetMagic) {
+		return "", fmt.Errorf("unexpected reply 0x%02x (%d bytes)", pong[0], len(pong))
+	}
+	l := int(binary.BigEndian.Uint16(pong[33:35]))
+	if 35+l > len(pong) {
+		return "", fmt.Errorf("truncated pong")
+	}
+	return string(pong[35 : 35+l]), nil
+}
+
+// OpenConnection sends an Open Connection Request 1, the first packet of a join.
+func (c *RakNetClient) OpenConnection() error {
+	req := append([]byte{raknetOpenConnectionReq1}, raknetMagic...)
+	req = append(req, 11) // RakNet protocol version
+	req = append(req, make([]byte, 1400-len(req))...)
+	_, err := c.Write(req)
+	return err
+}
+
+// Recv reads one datagram, waiting up to timeout.
+func (c *RakNetClient) Recv(timeout time.Duration) ([]byte, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,190 @@
+package mctest
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// SessionServer is a fake Mojang session server. Clients "join" through Join rather than over HTTP; the
+// proxy checks joins with GET /session/minecraft/hasJoined like a real server would.
+type SessionServer struct {
+	srv   *httptest.Server
+	mu    sync.Mutex
+	joins map[string]sessionJoin // serverId -> join
+}
+
+type sessionJoin struct {
+	name string
+	uuid [16]byte
+}
+
+// NewSessionServer starts a fake session server on loopback.
+func NewSessionServer() *SessionServer {
+	s := &SessionServer{joins: map[string]sessionJoin{}}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.hasJoined))
+	return s
+}
+
+// URL is the server's base URL, to use in place of https://sessionserver.mojang.com.
+func (s *SessionServer) URL() string { return s.srv.URL }
+
+func (s *SessionServer) Close() { s.srv.Close() }
+
+// Join records that the account name (uuid) joined the server identified by serverID, as the client
+// does before answering Encryption Request.
+func (s *SessionServer) Join(name string, uuid [16]byte, serverID string) {
+	s.mu.Lock()
+	s.joins[serverID] = sessionJoin{name, uuid}
+	s.mu.Unlock()
+}
+
+func (s *SessionServer) hasJoined(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/session/minecraft/hasJoined" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	j, ok := s.joins[r.URL.Query().Get("serverId")]
+	s.mu.Unlock()
+	if !ok || j.name != r.URL.Query().Get("username") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":         hex.EncodeToString(j.uuid[:]),
+		"name":       j.name,
+		"properties": []map[string]string{{"name": "textures", "value": "e30=", "signature": "c2ln"}},
+	})
+}
+
+// Encrypt answers the proxy's Encryption Request the way an online-mode client does: it picks a shared
+// secret, joins through sessions (unless sessions is nil, like a cracked client) and switches the
+// connection to encryption.
+func (cn *Conn) Encrypt(sessions *SessionServer, name string, uuid [16]byte) error {
+	id, body, err := cn.ReadPacket()
+	if err != nil {
+		return err
+	}
+	if id != 0x01 {
+		return fmt.Errorf("expected Encryption Request, got packet 0x%02x", id)
+	}
+	serverID, rest, err := ReadString(body)
+	if err != nil {
+		return err
+	}
+	der, rest, err := ReadString(rest)
+	if err != nil {
+		return err
+	}
+	token, _, err := ReadString(rest)
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParsePKIXPublicKey([]byte(der))
+	if err != nil {
+		return err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("public key is a %T", key)
+	}
+
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	if sessions != nil {
+		sessions.Join(name, uuid, ServerHash(serverID, secret, []byte(der)))
+	}
+	encSecret, err := rsa.EncryptPKCS1v15(rand.Reader, pub, secret)
+	if err != nil {
+		return err
+	}
+	encToken, err := rsa.EncryptPKCS1v15(rand.Reader, pub, []byte(token))
+	if err != nil {
+		return err
+	}
+	p := AppendString([]byte{0x01}, string(encSecret))
+	if cn.c.Protocol >= 759 && cn.c.Protocol < 761 {
+		p = append(p, 1) // has verify token
+	}
+	if err := cn.WritePacket(AppendString(p, string(encToken))); err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return err
+	}
+	cn.Conn = &cipherConn{Conn: cn.Conn, dec: newCFB8(block, secret, true), enc: newCFB8(block, secret, false)}
+	cn.r = bufio.NewReader(cn.Conn)
+	return nil
+}
+
+// ServerHash is the client's digest of the server ID, shared secret and public key, as sent to the
+// session server.
+func ServerHash(serverID string, secret, publicKey []byte) string {
+	h := sha1.New()
+	h.Write([]byte(serverID))
+	h.Write(secret)
+	h.Write(publicKey)
+	sum := h.Sum(nil)
+	n := new(big.Int).SetBytes(sum)
+	if sum[0]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(sum)*8)))
+	}
+	return n.Text(16)
+}
+
+type cipherConn struct {
+	net.Conn
+	dec, enc cipher.Stream
+}
+
+func (c *cipherConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.dec.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (c *cipherConn) Write(b []byte) (int, error) {
+	out := make([]byte, len(b))
+	c.enc.XORKeyStream(out, b)
+	return c.Conn.Write(out)
+}
+
+// cfb8 is AES/CFB8, the protocol's cipher.
+type cfb8 struct {
+	block   cipher.Block
+	sr, out []byte
+	decrypt bool
+}
+
+func newCFB8(block cipher.Block, iv []byte, decrypt bool) *cfb8 {
+	return &cfb8{block: block, sr: append([]byte(nil), iv...), out: make([]byte, block.BlockSize()), decrypt: decrypt}
+}
+
+func (x *cfb8) XORKeyStream(dst, src []byte) {
+	for i, b := range src {
+		x.block.Encrypt(x.out, x.sr)
+		c := b ^ x.out[0]
+		copy(x.sr, x.sr[1:])
+		if x.decrypt {
+			x.sr[len(x.sr)-1] = b
+		} else {
+			x.sr[len(x.sr)-1] = c
+		}
+		dst[i] = c
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// proxyListener is one address the proxy accepts Minecraft connections on, with its own routing, MOTD
+// and wake policy. The wake coordinator, backend watcher, metrics and session log are shared; the first
+// two belong to BACKEND_ADDR, so only listeners routing there gate joins on readiness or wake anything.
+type proxyListener struct {
+	Name     string   `json:"name"`
+	Addr     string   `json:"addr"`
+	Backend  string   `json:"backend"`  // default BACKEND_ADDR
+	Fallback string   `json:"fallback"` // default BACKEND_FALLBACK_ADDR
+	MOTD     string   `json:"motd"`     // default MOTD
+	Wake     *bool    `json:"wake"`     // whether joins here may wake the backend; default true
+	Policies []string `json:"policies"` // wake policies enforced here; omitted means all, [] means none
+	Query    string   `json:"query"`    // UDP address for the query protocol; empty disables it
+
+	// QueryBackend is the backend's own query port, used while it's up. Without one the proxy answers
+	// from the backend's status instead. Defaults to QUERY_BACKEND_ADDR on listeners routing there.
+	QueryBackend string `json:"query_backend"`
+
+	// Favicons are icon files or directories by backend state ("default", "sleeping", "starting",
+	// "online"), in place of the FAVICON_* ones.
+	Favicons map[string]string `json:"favicons"`
+
+	policy  policySet
+	managed bool // routes to the backend the proxy wakes and watches
+	icons   faviconSet
+	status  statusCache
+}
+
+// canWake reports whether connections on l may start the backend.
+func (l *proxyListener) canWake() bool {
+	return l.managed && (l.Wake == nil || *l.Wake)
+}
+
+// trusted reports whether l bypasses access control, as an operators' listener with "policies": []
+// does.
+func (l *proxyListener) trusted() bool {
+	return l.policy == policySet{}
+}
+
+// description is the MOTD l shows right now. It's the configured one (as provided, no rainbow
+// transformation) unless the proxy is draining, a wake is in flight, in which case it says how long the
+// server should take to come up, or policy would refuse to wake the sleeping backend.
+func (l *proxyListener) description() string {
+	if draining.Load() {
+		return getEnv("SHUTDOWN_MOTD", "§6Proxy is restarting, back in a moment")
+	}
+	// wake state is about BACKEND_ADDR, so other listeners keep their own MOTD
+	if !l.managed {
+		return l.MOTD
+	}
+	if inFlight, _, _ := wakes.progress(); inFlight {
+		return wakes.wakeMOTD()
+	}
+	if reason := wakeRefusal("", l.policy); reason != "" && l.canWake() && !backend.isUp() {
+		return reason
+	}
+	return l.MOTD
+}
+
+// favicons returns the icons l shows in the server list right now, which depend on the backend's state
+// for listeners routing to the backend the proxy manages.
+func (l *proxyListener) favicons() []string {
+	state := "default"
+	if l.managed {
+		if inFlight, _, _ := wakes.progress(); inFlight {
+			state = "starting"
+		} else if backend.isUp() {
+			state = "online"
+		} else {
+			state = "sleeping"
+		}
+	}
+	if l.icons != nil {
+		return l.icons.forState(state)
+	}
+	return favicons.forState(state)
+}
+
+// loadListeners reads LISTENERS, a JSON array of listeners given inline or as a path to a file, e.g.
+//
+//	[{"addr": ":25565"},
+//	 {"name": "test", "addr": ":25566", "backend": "mc-test:25565", "motd": "§bTest server",
+//	  "favicons": {"default": "/icons/test.png"}},
+//	 {"name": "ops", "addr": "127.0.0.1:25567", "policies": []}]
+//
+// Without LISTENERS the proxy has a single listener built from LISTEN_ADDR, BACKEND_ADDR, MOTD and
+// QUERY_ADDR.
+func loadListeners(backendAddr string) ([]*proxyListener, error) {
+	spec := getEnv("LISTENERS", "")
+	var ls []*proxyListener
+	switch {
+	case spec == "":
+		ls = []*proxyListener{{Name: "default", Addr: getEnv("LISTEN_ADDR", defaultListenAddr()), Query: getEnv("QUERY_ADDR", "")}}
+	case strings.HasPrefix(strings.TrimSpace(spec), "["):
+		if err := json.Unmarshal([]byte(spec), &ls); err != nil {
+			return nil, fmt.Errorf("LISTENERS: %w", err)
+		}
+	default:
+		data, err := os.ReadFile(spec)
+		if err != nil {
+			return nil, fmt.Errorf("LISTENERS: %w", err)
+		}
+		if err := json.Unmarshal(data, &ls); err != nil {
+			return nil, fmt.Errorf("LISTENERS %s: %w", spec, err)
+		}
+	}
+	if len(ls) == 0 {
+		return nil, fmt.Errorf("LISTENERS: no listeners configured")
+	}
+
+	names := map[string]bool{}
+	for _, l := range ls {
+		if l.Addr == "" {
+			return nil, fmt.Errorf("LISTENERS: listener %q has no addr", l.Name)
+		}
+		if l.Name == "" {
+			l.Name = l.Addr
+		}
+		if names[l.Name] {
+			return nil, fmt.Errorf("LISTENERS: duplicate listener name %q", l.Name)
+		}
+		names[l.Name] = true
+		if l.Backend == "" {
+			l.Backend = backendAddr
+		}
+		if l.Fallback == "" {
+			l.Fallback = fallbackBackend
+		}
+		if l.MOTD == "" {
+			l.MOTD = getEnv("MOTD", "§aMinecraft Server via Proxy")
+		}
+		l.managed = l.Backend == backendAddr
+		if l.QueryBackend == "" && l.managed {
+			l.QueryBackend = getEnv("QUERY_BACKEND_ADDR", "")
+		}
+		l.policy = allPolicies
+		if l.Policies != nil {
+			p, err := parsePolicies(l.Policies)
+			if err != nil {
+				return nil, fmt.Errorf("LISTENERS: listener %q: %w", l.Name, err)
+			}
+			l.policy = p
+		}
+		if l.Favicons != nil {
+			l.icons = faviconSet{}
+			for state, path := range l.Favicons {
+				if !slices.Contains(faviconStates, state) {
+					return nil, fmt.Errorf("LISTENERS: listener %q: unknown favicon state %q", l.Name, state)
+				}
+				l.icons.load(state, path)
+			}
+		}
+	}
+	return ls, nil
+}
+
+// parsePolicies turns policy names (quiet_hours, budget, quota) into a policySet.
+func parsePolicies(names []string) (policySet, error) {
+	var p policySet
+	for _, n := range names {
+		switch n {
+		case "quiet_hours":
+			p.quietHours = true
+		case "budget":
+			p.budget = true
+		case "quota":
+			p.quota = true
+		default:
+			return p, fmt.Errorf("unknown policy %q", n)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging installs a JSON (or, with LOG_FORMAT=text, plain text) slog handler at LOG_LEVEL
+// (debug, info, warn or error; default info). DEBUG=1 is kept as shorthand for LOG_LEVEL=debug.
+func setupLogging() {
+	level := slog.LevelInfo
+	if getEnv("DEBUG", "0") == "1" {
+		level = slog.LevelDebug
+	}
+	if v := getEnv("LOG_LEVEL", ""); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			defer slog.Warn("invalid LOG_LEVEL, using info", "value", v)
+			level = slog.LevelInfo
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+		// "1m30s" reads better than nanoseconds
+		if a.Value.Kind() == slog.KindDuration {
+			a.Value = slog.StringValue(a.Value.Duration().String())
+		}
+		return a
+	}}
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if strings.EqualFold(getEnv("LOG_FORMAT", "json"), "text") {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+}
+
+type loggerKey struct{}
+
+// withLogger returns ctx carrying l, so everything done on behalf of a connection logs with its ID.
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// logger returns the logger carried by ctx, or the default one.
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// newID returns a short random hex ID for correlating log lines.
+func newID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
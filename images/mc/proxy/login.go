@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// clientInfo is what the proxy learned about a connection before deciding where to send it.
+type clientInfo struct {
+	connID    string
+	listener  string // name of the listener the client connected to
+	nextState int
+	protocol  int32
+	username  string // from Login Start; empty for status pings or unparsable logins
+	uuid      string // sent by 1.19.1+ clients; empty otherwise
+	host      string // server address and port from the handshake of a login
+	port      int
+}
+
+// Protocol numbers where the login packets changed.
+const (
+	protocol1_19   = 759 // adds optional signature data
+	protocol1_19_1 = 760 // adds optional player UUID
+	protocol1_19_3 = 761 // Encryption Response always carries the verify token again
+	protocol1_20_2 = 764 // drops signature data, UUID always present; adds the configuration phase
+	protocol1_20_5 = 766 // adds transfers and "should authenticate" to Encryption Request
+	protocol1_21_2 = 768 // drops "strict error handling" from Login Success
+)
+
+// parseLoginStart extracts the username and, where the protocol carries it, the UUID from a serverbound
+// Login Start packet.
+func parseLoginStart(packet []byte, protocol int32) (name, uuid string, err error) {
+	if len(packet) < 1 || packet[0] != 0x00 {
+		return "", "", fmt.Errorf("not a login start")
+	}
+	offset := 1
+	n, m, err := readVarIntFromBytes(packet, offset)
+	if err != nil {
+		return "", "", err
+	}
+	offset += m
+	if n <= 0 || n > 64 || offset+int(n) > len(packet) {
+		return "", "", fmt.Errorf("invalid username length %d", n)
+	}
+	name = string(packet[offset : offset+int(n)])
+	offset += int(n)
+
+	switch {
+	case protocol >= protocol1_20_2:
+		if offset+16 <= len(packet) {
+			uuid = formatUUID(packet[offset : offset+16])
+		}
+	case protocol >= protocol1_19:
+		// bool has signature data, then [i64 expiry, VarInt-prefixed key, VarInt-prefixed signature]
+		if offset >= len(packet) {
+			return name, "", nil
+		}
+		hasSig := packet[offset] == 1
+		offset++
+		if hasSig {
+			offset += 8
+			for i := 0; i < 2; i++ {
+				var err error
+				if _, offset, err = readBytes(packet, offset); err != nil {
+					return name, "", nil
+				}
+			}
+		}
+		if protocol >= protocol1_19_1 && offset+17 <= len(packet) && packet[offset] == 1 {
+			uuid = formatUUID(packet[offset+1 : offset+17])
+		}
+	}
+	return name, uuid, nil
+}
+
+// formatUUID renders 16 raw bytes in the dashed form used by Mojang APIs.
+func formatUUID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
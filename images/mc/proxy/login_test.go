@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseLoginStart(t *testing.T) {
+	id := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	const uuid = "01234567-89ab-cdef-0123-456789abcdef"
+	login := func(fields ...[]byte) []byte {
+		p := appendString([]byte{0x00}, "alice")
+		for _, f := range fields {
+			p = append(p, f...)
+		}
+		return p
+	}
+	expiry := make([]byte, 8)
+	for _, tc := range []struct {
+		name     string
+		packet   []byte
+		protocol int32
+		wantName string
+		wantUUID string
+		wantErr  bool
+	}{
+		{"1.20.2", login(id), protocol1_20_2, "alice", uuid, false},
+		{"1.19.1 without signature", login([]byte{0}, []byte{1}, id), protocol1_19_1, "alice", uuid, false},
+		{"1.19.1 with signature", login([]byte{1}, expiry, appendBytes(nil, []byte("key")), appendBytes(nil, []byte("sig")), []byte{1}, id), protocol1_19_1, "alice", uuid, false},
+		{"old client", login(), 47, "alice", "", false},
+		{"not a login start", []byte{0x01, 0x05}, 47, "", "", true},
+		{"empty", nil, 47, "", "", true},
+		{"name runs past the packet", []byte{0x00, 0x10, 'a'}, 47, "", "", true},
+		{"negative name length", []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0x0f}, 47, "", "", true},
+		{"VarInt too big", []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 47, "", "", true},
+		{"negative key length", login([]byte{1}, expiry, []byte{0x91, 0x80, 0x80, 0x80, 0x08}, []byte{0, 0, 0}), protocol1_19_1, "alice", "", false},
+		{"key runs past the packet", login([]byte{1}, expiry, []byte{0x7f}, []byte("short")), protocol1_19_1, "alice", "", false},
+		{"signature flag without a signature", login([]byte{1}), protocol1_19_1, "alice", "", false},
+		{"truncated UUID", login(id[:4]), protocol1_20_2, "alice", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name, uuid, err := parseLoginStart(tc.packet, tc.protocol)
+			if (err != nil) != tc.wantErr || name != tc.wantName || uuid != tc.wantUUID {
+				t.Errorf("parseLoginStart = %q, %q, %v; want %q, %q, error %v", name, uuid, err, tc.wantName, tc.wantUUID, tc.wantErr)
+			}
+		})
+	}
+}
+
+func FuzzParseLoginStart(f *testing.F) {
+	f.Add(appendString([]byte{0x00}, "alice"), int32(protocol1_19_1))
+	f.Add([]byte{0x00, 0x05, 'a', 'l', 'i', 'c', 'e', 1, 0, 0, 0, 0, 0, 0, 0, 0, 0x91, 0x80, 0x80, 0x80, 0x08}, int32(protocol1_19))
+	f.Fuzz(func(t *testing.T, packet []byte, protocol int32) {
+		parseLoginStart(packet, protocol)
+	})
+}
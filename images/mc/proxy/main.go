@@ -1,92 +1,196 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
-var faviconData string
 var (
 	initialReadTimeout time.Duration
 	statusReadTimeout  time.Duration
 	pingReadTimeout    time.Duration
+	loginReadTimeout   time.Duration
 )
 
 const azureScope = "https://management.azure.com/.default"
 
-var lastStartTime time.Time
+// startMu guards lastStartTime and starting, so concurrent joins against a sleeping backend send ARM
+// a single start request.
+var (
+	startMu       sync.Mutex
+	lastStartTime time.Time
+	starting      bool
+)
+
+// wakePending reports whether the backend is on its way up: a start request is being sent or a wake
+// is waiting for it to become ready.
+func wakePending() bool {
+	if inFlight, _, _ := wakes.progress(); inFlight {
+		return true
+	}
+	startMu.Lock()
+	defer startMu.Unlock()
+	return starting
+}
 
 func main() {
-	listenAddr := getEnv("LISTEN_ADDR", ":25565")
+	setupLogging()
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	shutdownTracing := setupTracing(context.Background())
+	defer shutdownTracing(context.Background())
+	bedrockMode.Store(getEnv("PROXY_MODE", "java") == "bedrock")
 	backendAddr := getEnv("BACKEND_ADDR", "minecraft-java:25565")
-	motd := getEnv("MOTD", "§aMinecraft Server via Proxy")
 
-	// Load favicon if pRrovided. Accept raw base64 in FAVICON_BASE64 or a file path in FAVICON_PATH.
-	if fb := getEnv("FAVICON_BASE64", ""); fb != "" {
-		// if it already includes data: prefix, keep as-is, else prepend PNG data URL
-		if strings.HasPrefix(fb, "data:") {
-			faviconData = fb
-		} else {
-			faviconData = "data:image/png;base64," + fb
+	favicons = loadFavicons()
+
+	loadTimeouts()
+	spliceOpts = loadSpliceConfig()
+	backendDialTimeout = time.Duration(getEnvInt("BACKEND_DIAL_TIMEOUT_MS", 2000)) * time.Millisecond
+	fallbackBackend = getEnv("BACKEND_FALLBACK_ADDR", "")
+	proxyListeners, err := loadListeners(backendAddr)
+	if err != nil {
+		slog.Error("invalid listener config", "err", err)
+		os.Exit(1)
+	}
+
+	slog.Info("starting proxy", "backend", backendAddr, "fallback", fallbackBackend, "bedrock", bedrockMode.Load())
+	for _, l := range proxyListeners {
+		slog.Info("listener", "name", l.Name, "addr", l.Addr, "backend", l.Backend, "fallback", l.Fallback,
+			"motd", l.MOTD, "wake", l.canWake(), "policies", l.Policies)
+	}
+	slog.Info("timeouts",
+		"initial", initialReadTimeout, "status", statusReadTimeout, "ping", pingReadTimeout, "login", loginReadTimeout,
+		"idle", spliceOpts.idleTimeout, "max", spliceOpts.maxDuration)
+
+	wakes = newWakeTracker(backendAddr)
+	backend = newBackendWatcher(backendAddr)
+	budget = newBudgetGuard()
+	backend.onChange(budget.onBackendChange)
+	backend.onChange(func(bool, time.Time) { invalidateStatus() })
+	go backend.run()
+	go budget.run()
+	sessions = newSessionLog()
+	adminMux.HandleFunc("GET /admin/sessions", sessions.handleAdmin)
+	ledger = newWakeLedger()
+	adminMux.HandleFunc("GET /admin/wakes", ledger.handleAdmin)
+	quietHours = newAvailability()
+	if quietHours != nil {
+		go quietHours.run()
+	}
+	adminMux.HandleFunc("GET /admin/budget", budget.handleGet)
+	adminMux.HandleFunc("POST /admin/budget/override", requireAdmin(budget.handleOverride))
+	adminMux.HandleFunc("DELETE /admin/budget/override", requireAdmin(budget.handleOverride))
+	statusWakes = newStatusWaker()
+	pingCheck = newPingFilter()
+	notify = newNotifier()
+	auth = newOnlineAuth()
+	prewarm = newPrewarmer()
+	if getEnv("PREWARM", "0") == "1" {
+		go prewarm.run()
+	}
+	adminMux.HandleFunc("GET /admin/prewarm", prewarm.handleAdmin)
+	captures = newCapturer()
+
+	metrics.describe("mcproxy_wake_requests_total", "counter", "Backend wake requests by trigger and result.")
+	startAdminServer(getEnv("ADMIN_ADDR", ""))
+
+	// Bind every listener before serving any, so a bad address fails startup instead of half of it.
+	var netListeners []net.Listener
+	var closers []io.Closer // closed by the drain, to stop taking players
+	for _, l := range proxyListeners {
+		if bedrockMode.Load() {
+			conn, err := startBedrockListener(l)
+			if err != nil {
+				slog.Error("listen failed", "listener", l.Name, "addr", l.Addr, "err", err)
+				os.Exit(1)
+			}
+			closers = append(closers, conn)
+			continue
 		}
-	} else if fp := getEnv("FAVICON_PATH", ""); fp != "" {
-		if dat, err := os.ReadFile(fp); err == nil {
-			faviconData = "data:image/png;base64," + base64.StdEncoding.EncodeToString(dat)
-		} else {
-			log.Printf("Failed to read FAVICON_PATH=%s: %v", fp, err)
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			slog.Error("listen failed", "listener", l.Name, "addr", l.Addr, "err", err)
+			os.Exit(1)
+		}
+		defer ln.Close()
+		netListeners = append(netListeners, ln)
+		closers = append(closers, ln)
+		qconn, err := startQueryResponder(l)
+		if err != nil {
+			slog.Error("query listen failed", "listener", l.Name, "addr", l.Query, "err", err)
+			os.Exit(1)
+		}
+		if qconn != nil {
+			closers = append(closers, qconn)
 		}
 	}
+	listening.Store(int32(len(proxyListeners)))
+	startHealthServer(getEnv("HEALTH_ADDR", ""))
 
-	// Configure timeouts (ms) from environment with sensible defaults.
-	initialReadMs := getEnvInt("INITIAL_READ_MS", 300)
-	statusReadMs := getEnvInt("STATUS_READ_MS", 300)
-	pingWaitMs := getEnvInt("PING_WAIT_MS", 300)
-	initialReadTimeout = time.Duration(initialReadMs) * time.Millisecond
-	statusReadTimeout = time.Duration(statusReadMs) * time.Millisecond
-	pingReadTimeout = time.Duration(pingWaitMs) * time.Millisecond
-
-	log.Printf("Starting proxy: %s -> %s", listenAddr, backendAddr)
-	log.Printf("MOTD: %s", motd)
-	log.Printf("timeouts: initial=%s status=%s ping=%s", initialReadTimeout, statusReadTimeout, pingReadTimeout)
-
-	listener, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		log.Fatal(err)
+	for i, ln := range netListeners {
+		go acceptLoop(ln, proxyListeners[i])
 	}
-	defer listener.Close()
+	handleShutdown(closers)
+}
 
+func acceptLoop(ln net.Listener, l *proxyListener) {
 	for {
-		clientConn, err := listener.Accept()
+		clientConn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			listening.Add(-1)
+			return
+		}
 		if err != nil {
-			log.Printf("Accept error: %v", err)
+			slog.Warn("accept failed", "listener", l.Name, "err", err)
 			continue
 		}
 
-		go handleConnection(clientConn, backendAddr, motd)
+		spliceOpts.tuneTCP(clientConn)
+		go handleConnection(clientConn, l)
 	}
 }
 
-func handleConnection(clientConn net.Conn, backendAddr string, motd string) {
+// loadTimeouts configures the client read timeouts (ms) from environment with sensible defaults.
+func loadTimeouts() {
+	initialReadTimeout = time.Duration(getEnvInt("INITIAL_READ_MS", 300)) * time.Millisecond
+	statusReadTimeout = time.Duration(getEnvInt("STATUS_READ_MS", 300)) * time.Millisecond
+	pingReadTimeout = time.Duration(getEnvInt("PING_WAIT_MS", 300)) * time.Millisecond
+	loginReadTimeout = time.Duration(getEnvInt("LOGIN_READ_MS", 2000)) * time.Millisecond
+}
+
+func handleConnection(clientConn net.Conn, l *proxyListener) {
+	clientConn = captures.wrap(clientConn)
 	defer clientConn.Close()
 
-	if getEnv("DEBUG", "0") == "1" {
-		log.Printf("New connection from %s", clientConn.RemoteAddr())
-	}
+	// Everything done for this connection, through to the wake and the splice, logs with its ID.
+	connID := newID()
+	info := clientInfo{connID: connID, listener: l.Name}
+	defer func() { captures.finish(clientConn, l, info) }()
+	ctx := withLogger(context.Background(),
+		slog.With("conn", connID, "listener", l.Name, "remote", clientConn.RemoteAddr().String()))
+	ctx, span := startSpan(ctx, "connection", attribute.String("conn.id", connID),
+		attribute.String("listener", l.Name), attribute.String("client.address", remoteIP(clientConn.RemoteAddr())))
+	defer span.End()
+	logger(ctx).Debug("new connection")
+	_, hs := startSpan(ctx, "handshake")
 
 	// Set short read timeout for initial packet so we don't block waiting for a full handshake.
 	// This lets us reply to status requests much faster when the client sends them immediately.
@@ -101,34 +205,80 @@ func handleConnection(clientConn net.Conn, backendAddr string, motd string) {
 		// Treat an immediate EOF as a probe and avoid noisy logs. Use a small threshold so
 		// genuine client errors are still visible.
 		if err == io.EOF && readElapsed < 50*time.Millisecond {
+			hs.End()
 			return
 		}
-		log.Printf("Failed to read packet after %s: %v", readElapsed, err)
+		logger(ctx).Warn("failed to read first packet", "elapsed", readElapsed, "err", err)
+		endSpan(hs, err)
 		return
 	}
-	log.Printf("Initial read took %s", readElapsed)
+	logger(ctx).Debug("initial read", "elapsed", readElapsed)
 
 	// Clear the short deadline used for the initial read so future I/O isn't affected.
 	clientConn.SetReadDeadline(time.Time{})
 
 	// If it's a handshake packet (0x00), parse it to get next state and protocol
-	nextState := 0
-	var protocol int32
+	packets := [][]byte{packet}
 	if len(packet) > 0 && packet[0] == 0x00 {
 		ns, proto, err := parseHandshake(packet)
 		if err == nil {
-			nextState = ns
-			protocol = proto
+			info.nextState = ns
+			info.protocol = proto
+			span.SetAttributes(attribute.Int("mc.next_state", ns), attribute.Int("mc.protocol", int(proto)))
+		}
+		if err == nil && info.nextState == 1 {
+			hs.End()
+			handleStatusRequest(ctx, l, clientConn, info.protocol)
+			return
+		}
+	}
+
+	// Players held by online authentication come back as transfers; to the backend they're ordinary
+	// logins, so it doesn't need to accept transfers.
+	if info.nextState == 3 && auth != nil && transferAsLogin(packet) {
+		info.nextState = 2
+	}
+
+	// Logins follow the handshake with Login Start, which names the player. Read it up front so wakes
+	// can be attributed (and limited) per player; it's forwarded to the backend along with the handshake.
+	if info.nextState == 2 {
+		info.host, info.port = handshakeAddr(packet)
+		clientConn.SetReadDeadline(time.Now().Add(loginReadTimeout))
+		loginStart, err := readPacket(clientConn)
+		clientConn.SetReadDeadline(time.Time{})
+		if err != nil {
+			logger(ctx).Warn("failed to read Login Start", "err", err)
+			endSpan(hs, err)
+			return
+		}
+		packets = append(packets, loginStart)
+		if name, uuid, err := parseLoginStart(loginStart, info.protocol); err == nil {
+			info.username, info.uuid = name, uuid
+			ctx = withLogger(ctx, logger(ctx).With("player", name))
+			span.SetAttributes(attribute.String("mc.player", name))
+			logger(ctx).Info("login", "protocol", info.protocol, "uuid", uuid)
+		} else {
+			logger(ctx).Warn("unparsable Login Start", "err", err)
 		}
-		if err == nil && nextState == 1 {
-			handleStatusRequest(clientConn, motd, protocol)
+	}
+	hs.End()
+
+	if draining.Load() && info.nextState != 1 {
+		sendDisconnectJSON(clientConn, shutdownMessage())
+		return
+	}
+	if info.nextState == 2 && !l.trusted() {
+		if reason := pingCheck.refusal(remoteIP(clientConn.RemoteAddr()), info.username); reason != "" {
+			logger(ctx).Info("login without a recent status ping; asking client to refresh")
+			metrics.inc("mcproxy_ping_filter_refusals_total", "listener", l.Name)
+			sendDisconnectJSON(clientConn, reason)
 			return
 		}
 	}
 
 	// For all other packets, proxy to backend. Pass along the parsed nextState so we can
 	// send a friendly Disconnect if the backend is unavailable during login.
-	proxyToBackend(clientConn, backendAddr, packet, nextState, protocol)
+	proxyToBackend(ctx, l, clientConn, packets, info)
 }
 
 func readPacket(conn net.Conn) ([]byte, error) {
@@ -155,14 +305,14 @@ func readPacket(conn net.Conn) ([]byte, error) {
 func readVarInt(conn net.Conn) (int32, error) {
 	var value int32
 	var position int
+	var buf [1]byte
 
 	for {
 		if position >= 5 {
 			return 0, fmt.Errorf("VarInt too big")
 		}
 
-		buf := make([]byte, 1)
-		_, err := conn.Read(buf)
+		_, err := conn.Read(buf[:])
 		if err != nil {
 			return 0, err
 		}
@@ -237,8 +387,10 @@ func readVarIntFromBytes(b []byte, offset int) (int32, int, error) {
 	return value, i - offset, nil
 }
 
-func handleStatusRequest(clientConn net.Conn, motd string, protocol int32) {
-	log.Printf("Handling status request: (protocol=%d)", protocol)
+func handleStatusRequest(ctx context.Context, l *proxyListener, clientConn net.Conn, protocol int32) {
+	logger(ctx).Debug("status request", "protocol", protocol)
+	_, span := startSpan(ctx, "status")
+	defer span.End()
 	// First try to consume the client's Status Request packet (usually sent right after the handshake).
 	// Use a short deadline; if not present we still continue and send the status response.
 	clientConn.SetReadDeadline(time.Now().Add(statusReadTimeout))
@@ -246,113 +398,7 @@ func handleStatusRequest(clientConn net.Conn, motd string, protocol int32) {
 	// clear deadline before writing
 	clientConn.SetReadDeadline(time.Time{})
 
-	// Build status response including version.protocol so client doesn't mark server as "Old".
-	statusObj := struct {
-		Description struct {
-			Text string `json:"text"`
-		} `json:"description"`
-		Players struct {
-			Max    int `json:"max"`
-			Online int `json:"online"`
-			Sample []struct {
-				Name string `json:"name"`
-				ID   string `json:"id"`
-			} `json:"sample,omitempty"`
-		} `json:"players"`
-		Favicon string `json:"favicon,omitempty"`
-		Version struct {
-			Name     string `json:"name"`
-			Protocol int32  `json:"protocol"`
-		} `json:"version"`
-	}{}
-	// MOTD: use value as provided (no rainbow transformation)
-	statusObj.Description.Text = motd
-	statusObj.Players.Online = 0
-	statusObj.Players.Max = 0
-	// Allow overriding player counts via environment variables
-	if v := getEnv("PLAYERS_MAX", ""); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			statusObj.Players.Max = n
-		} else {
-			log.Printf("Invalid PLAYERS_MAX=%q: %v", v, err)
-		}
-	}
-	if v := getEnv("PLAYERS_ONLINE", ""); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			statusObj.Players.Online = n
-		} else {
-			log.Printf("Invalid PLAYERS_ONLINE=%q: %v", v, err)
-		}
-	}
-	// Optionally include a short message in the players.sample list.
-	// This shows up in the client when hovering the player count. It cannot replace the numeric count
-	sampleEnv := getEnv("PLAYER_SAMPLE", "")
-	if sampleEnv != "" {
-		// allow comma or pipe separated list
-		var parts []string
-		if strings.Contains(sampleEnv, "|") {
-			parts = strings.Split(sampleEnv, "|")
-		} else {
-			parts = strings.Split(sampleEnv, ",")
-		}
-
-		// clean and collect non-empty entries
-		entries := make([]string, 0, len(parts))
-		for _, p := range parts {
-			p = strings.TrimSpace(p)
-			if p == "" {
-				continue
-			}
-			if len(p) > 32 {
-				p = p[:32]
-			}
-			entries = append(entries, p)
-		}
-
-		if len(entries) > 0 {
-			// always randomize the order so the sample shown is different each status
-			r := rand.New(rand.NewSource(time.Now().UnixNano()))
-			r.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
-
-			maxSamples := 5
-			if len(entries) < maxSamples {
-				maxSamples = len(entries)
-			}
-
-			samples := make([]struct {
-				Name string `json:"name"`
-				ID   string `json:"id"`
-			}, 0, maxSamples)
-			dummyID := "00000000-0000-0000-0000-000000000000"
-			for i := 0; i < maxSamples; i++ {
-				samples = append(samples, struct {
-					Name string `json:"name"`
-					ID   string `json:"id"`
-				}{Name: entries[i], ID: dummyID})
-			}
-			statusObj.Players.Sample = samples
-		}
-	}
-	// static version name (no rotating frame token)
-	statusObj.Version.Name = fmt.Sprintf("proxy-%d", protocol)
-	statusObj.Version.Protocol = protocol
-	if faviconData != "" {
-		statusObj.Favicon = faviconData
-	}
-
-	statusBytes, err := json.Marshal(statusObj)
-	if err != nil {
-		log.Printf("Failed to marshal status JSON: %v", err)
-		return
-	}
-
-	var packet []byte
-	packet = append(packet, 0x00)                          // Packet ID
-	packet = appendVarInt(packet, int32(len(statusBytes))) // String length
-	packet = append(packet, statusBytes...)                // JSON data
-
-	writeVarInt(clientConn, int32(len(packet)))
-	clientConn.Write(packet)
+	clientConn.Write(l.status.response(l, protocol))
 
 	// Now wait for the ping and echo it back. Use a small window so we don't artificially add seconds
 	// to the client's measured latency.
@@ -365,27 +411,19 @@ func handleStatusRequest(clientConn net.Conn, motd string, protocol int32) {
 	}
 
 	if len(pingPacket) > 0 && pingPacket[0] == 0x01 {
-		log.Printf("Echoing ping back to %s", clientConn.RemoteAddr())
-		writeVarInt(clientConn, int32(len(pingPacket)))
-		clientConn.Write(pingPacket)
-	}
-}
-
-func writeVarInt(conn net.Conn, value int32) {
-	for {
-		temp := byte(value & 0x7F)
-		value >>= 7
-		if value != 0 {
-			temp |= 0x80
-		}
-		conn.Write([]byte{temp})
-		if value == 0 {
-			break
+		logger(ctx).Debug("echoing ping")
+		var buf [16]byte // the length and an 8 byte ping
+		clientConn.Write(append(appendVarInt(buf[:0], int32(len(pingPacket))), pingPacket...))
+		pingCheck.onPing(remoteIP(clientConn.RemoteAddr()))
+		if l.canWake() {
+			go statusWakes.onStatus(ctx, clientConn.RemoteAddr(), protocol, l)
 		}
 	}
 }
 
-func appendVarInt(data []byte, value int32) []byte {
+func appendVarInt(data []byte, v int32) []byte {
+	// VarInts encode the two's complement bits, so shift unsigned or negative values never terminate
+	value := uint32(v)
 	for {
 		temp := byte(value & 0x7F)
 		value >>= 7
@@ -400,76 +438,264 @@ func appendVarInt(data []byte, value int32) []byte {
 	return data
 }
 
-func proxyToBackend(clientConn net.Conn, backendAddr string, firstPacket []byte, nextState int, protocol int32) {
-	// Connect to backend
-	backendConn, err := net.Dial("tcp", backendAddr)
+func proxyToBackend(ctx context.Context, l *proxyListener, clientConn net.Conn, packets [][]byte, info clientInfo) {
+	nextState := info.nextState
+	backendAddr, fallback := l.Backend, l.Fallback
+	sess := sessions.start(clientConn, backendAddr, info)
+
+	// Decide out-of-band whether the backend can take a player. Only when that's inconclusive do we
+	// fall back to watching how the backend treats the connection. Only logins are checked and can wake
+	// the backend; anything else reaching this point (scanners, unparsable first packets, transfers)
+	// names no player for wake policy to judge.
+	state := readinessUnknown
+	if nextState == 2 && l.managed {
+		_, rs := startSpan(ctx, "backend.readiness")
+		state = backend.readiness()
+		rs.SetAttributes(attribute.String("backend.readiness", state.String()))
+		rs.End()
+		captureNote(clientConn, "backend readiness: "+state.String())
+	}
+	if state == backendNotReady {
+		if fallback == "" {
+			logger(ctx).Info("backend not ready, not forwarding", "backend", backendAddr)
+			sessions.finish(sess, closeBackendDown, nil)
+			wakeAndDisconnect(ctx, l, clientConn, info)
+			return
+		}
+		// With a fallback (e.g. a lobby) the player waits there while the backend starts.
+		logger(ctx).Info("backend not ready, sending to fallback", "backend", backendAddr, "fallback", fallback)
+		go wakeFor(ctx, l, clientConn.RemoteAddr(), info)
+		backendAddr, state = fallback, readinessUnknown
+	}
+
+	backendConn, err := connectBackend(ctx, backendAddr, packets, sess)
+	if err != nil && backendAddr != fallback && fallback != "" {
+		logger(ctx).Warn("backend unreachable, trying fallback", "backend", backendAddr, "fallback", fallback, "err", err)
+		backendAddr = fallback
+		backendConn, err = connectBackend(ctx, backendAddr, packets, sess)
+	}
 	if err != nil {
-		log.Printf("Backend connection failed: %v", err)
-		// If the client intended to login (nextState == 2) or play (1), send a friendly disconnect JSON
-		// so the client shows a message instead of a generic network error.
-		if nextState == 2 || nextState == 1 {
-			message := getEnv("DISCONNECT_MESSAGE", "Uhoh spaghetti")
-			sendDisconnectJSON(clientConn, message)
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Op == "dial" {
+			logger(ctx).Warn("backend connection failed", "backend", backendAddr, "err", err)
+			sessions.finish(sess, closeDialFailed, err)
+			// If the client intended to login (nextState == 2) or play (1), send a friendly disconnect JSON
+			// so the client shows a message instead of a generic network error.
+			if nextState == 2 || nextState == 1 {
+				message := getEnv("DISCONNECT_MESSAGE", "Uhoh spaghetti")
+				if inFlight, _, _ := wakes.progress(); inFlight && l.managed {
+					message += "\n§7Server is " + wakes.etaText()
+				}
+				sendDisconnectJSON(clientConn, message)
+			}
+			return
 		}
+		logger(ctx).Warn("write to backend failed", "err", err)
+		sessions.finish(sess, closeError, err)
+		message := getEnv("DISCONNECT_MESSAGE", "Uhoh mama-mia")
+		sendDisconnectJSON(clientConn, message)
 		return
 	}
-	defer backendConn.Close()
+	defer func() { backendConn.Close() }()
+
+	var prefix []byte
+	if state == readinessUnknown {
+		// Fallback: peek for any immediate backend response or immediate close. If the backend accepted
+		// TCP but immediately closed/reset (common when the port is open but no Minecraft server is
+		// running), the Read will return an error (not a timeout).
+		backendConn.SetReadDeadline(time.Now().Add(1000 * time.Millisecond))
+		buf := make([]byte, 2048)
+		n, err := backendConn.Read(buf)
+		// clear the deadline
+		backendConn.SetReadDeadline(time.Time{})
+		prefix = buf[:n]
+		if err != nil {
+			// If it's a timeout, the backend is simply quiet — proceed to normal proxying.
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				// backend closed/reset immediately
+				logger(ctx).Info("backend closed immediately after connect", "backend", backendAddr, "err", err)
+				if nextState != 2 {
+					sessions.finish(sess, closeBackendDown, err)
+					return
+				}
+				if backendAddr == fallback || fallback == "" {
+					sessions.finish(sess, closeBackendDown, err)
+					wakeAndDisconnect(ctx, l, clientConn, info)
+					return
+				}
+				backendConn.Close()
+				go wakeFor(ctx, l, clientConn.RemoteAddr(), info)
+				backendAddr = fallback
+				if backendConn, err = connectBackend(ctx, backendAddr, packets, sess); err != nil {
+					logger(ctx).Warn("fallback connection failed", "backend", backendAddr, "err", err)
+					sessions.finish(sess, closeDialFailed, err)
+					wakeAndDisconnect(ctx, l, clientConn, info)
+					return
+				}
+				prefix = nil
+			}
+		}
+	}
+
+	// players on the fallback aren't on the server yet
+	joined := nextState == 2 && l.managed && backendAddr != fallback
+	if joined {
+		go prewarm.recordSessionStart(time.Now())
+		notify.send("join", "player", info.username)
+	}
+	sessions.setBackend(sess, backendAddr)
+	logger(ctx).Info("proxying", "backend", backendAddr, "next_state", nextState)
 
-	log.Printf("Proxying connection to %s", backendAddr)
+	captureNote(clientConn, "splice to "+backendAddr)
+	clientConn = stopCapture(clientConn)
 
-	// Send the first packet to backend
-	if len(firstPacket) > 0 {
-		writeVarInt(backendConn, int32(len(firstPacket)))
-		if _, err := backendConn.Write(firstPacket); err != nil {
-			log.Printf("Write to backend failed: %v", err)
-			message := getEnv("DISCONNECT_MESSAGE", "Uhoh mama-mia")
-			sendDisconnectJSON(clientConn, message)
-			return
-		}
+	// Start proxying. If we read initial bytes from backend, they're delivered to the client first.
+	spliceOpts.tuneTCP(backendConn)
+	_, ss := startSpan(ctx, "splice", attribute.String("server.address", backendAddr))
+	reason, err := spliceOpts.splice(clientConn, backendConn, prefix, &sess.bytesUp, &sess.bytesDown)
+	ss.SetAttributes(attribute.String("close_reason", reason),
+		attribute.Int64("bytes_up", sess.bytesUp.Load()), attribute.Int64("bytes_down", sess.bytesDown.Load()))
+	endSpan(ss, err)
+	sessions.finish(sess, reason, err)
+	logger(ctx).Info("session closed", "reason", reason, "err", err,
+		"bytes_up", sess.bytesUp.Load(), "bytes_down", sess.bytesDown.Load())
+	if joined {
+		notify.send("leave", "player", info.username, "duration", roughDuration(time.Since(sess.rec.Start)))
 	}
+}
 
-	// Peek for any immediate backend response or immediate close. If the backend accepted TCP
-	// but immediately closed/reset (common when the port is open but no Minecraft server is running),
-	// the Read will return an error (not a timeout). Use a short deadline to avoid delaying normal proxies.
-	backendConn.SetReadDeadline(time.Now().Add(1000 * time.Millisecond))
-	buf := make([]byte, 2048)
-	n, err := backendConn.Read(buf)
-	// clear the deadline
-	backendConn.SetReadDeadline(time.Time{})
+// connectBackend dials addr and replays the packets read from the client so far. Dial failures come
+// back as dial *net.OpErrors; anything else is a write failure.
+func connectBackend(ctx context.Context, addr string, packets [][]byte, sess *session) (net.Conn, error) {
+	_, ds := startSpan(ctx, "backend.dial", attribute.String("server.address", addr))
+	conn, err := dialBackend(ctx, addr, backendDialTimeout)
+	endSpan(ds, err)
 	if err != nil {
-		// If it's a timeout, the backend is simply quiet — proceed to normal proxying.
-		if ne, ok := err.(net.Error); ok && ne.Timeout() {
-			// continue below to normal proxying without buffered data
-		} else {
-			// backend closed/reset immediately — send friendly disconnect
-			log.Printf("Backend connection closed immediately after connect/write: %v", err)
-			message := getEnv("DISCONNECT_MESSAGE_2", "§eGet some water and try reconnecting in a minute while the server starts up!")
-			sendDisconnectJSON(clientConn, message)
-			startAzureContainerApp()
-			return
+		return nil, err
+	}
+	var sent int64
+	for _, packet := range packets {
+		frame := appendVarInt(nil, int32(len(packet)))
+		frame = append(frame, packet...)
+		if _, err := conn.Write(frame); err != nil {
+			conn.Close()
+			return nil, err
 		}
+		sent += int64(len(frame))
 	}
+	sess.bytesUp.Add(sent)
+	return conn, nil
+}
 
-	// Start proxying. If we read initial bytes from backend, prepend them back to the stream.
-	if n > 0 {
-		// Non-blocking: copy client->backend and backend(buffer+conn)->client
-		go io.Copy(backendConn, clientConn)
-		r := io.MultiReader(bytes.NewReader(buf[:n]), backendConn)
-		io.Copy(clientConn, r)
+// wakeFor starts the backend on behalf of a player without disconnecting them, for when they're being
+// sent to the fallback backend meanwhile. Wake policy still applies; a refused player just stays put.
+func wakeFor(ctx context.Context, l *proxyListener, remote net.Addr, info clientInfo) {
+	if inFlight, _, _ := wakes.progress(); inFlight || !l.canWake() {
 		return
 	}
+	startAzureContainerApp(ctx, wakeEntry{
+		Trigger: "login",
+		Player:  info.username,
+		UUID:    info.uuid,
+		IP:      remoteIP(remote),
+	}, l.policy)
+}
 
-	// No immediate data — normal bidirectional proxying
-	go io.Copy(backendConn, clientConn)
-	io.Copy(clientConn, backendConn)
+// wakeAndDisconnect tells a player the backend isn't up yet and starts it, unless wake policy refuses
+// or the listener they came in on doesn't wake the backend.
+func wakeAndDisconnect(ctx context.Context, l *proxyListener, clientConn net.Conn, info clientInfo) {
+	if !l.canWake() {
+		sendDisconnectJSON(clientConn, getEnv("DISCONNECT_MESSAGE", "Uhoh spaghetti"))
+		return
+	}
+	// With online authentication, the player has to prove who they are before anything is done in
+	// their name.
+	var profile *gameProfile
+	if auth != nil {
+		conn, p, err := auth.authenticate(ctx, clientConn, info)
+		if err != nil {
+			logger(ctx).Info("online authentication failed", "err", err)
+			if conn != nil {
+				sendDisconnectJSON(conn, auth.message)
+			}
+			return
+		}
+		clientConn, profile = conn, p
+		info.username, info.uuid = p.Name, p.uuid()
+	}
+	// A wake someone else already started isn't this player's to pay for, so policy only
+	// applies when this login would start one.
+	if inFlight, _, _ := wakes.progress(); !inFlight {
+		if reason := wakeRefusal(info.username, l.policy); reason != "" {
+			logger(ctx).Info("not waking backend", "reason", reason)
+			sendDisconnectJSON(clientConn, reason)
+			return
+		}
+	}
+	cause := wakeEntry{
+		Trigger: "login",
+		Player:  info.username,
+		UUID:    info.uuid,
+		IP:      remoteIP(clientConn.RemoteAddr()),
+	}
+	if auth.canHold(info) {
+		started := make(chan string, 1)
+		go func() { started <- startAzureContainerApp(ctx, cause, l.policy) }()
+		if err := auth.holdAndTransfer(ctx, clientConn, info, profile, started); err != nil {
+			logger(ctx).Info("held player not transferred", "err", err)
+		}
+		return
+	}
+	message := getEnv("DISCONNECT_MESSAGE_2", "§eGet some water and try reconnecting in a minute while the server starts up!")
+	message += "\n§7Server is " + wakes.etaText()
+	sendDisconnectJSON(clientConn, message)
+	startAzureContainerApp(ctx, cause, l.policy)
 }
 
-func startAzureContainerApp() {
+// startAzureContainerApp asks ARM to start the backend container app, subject to policies. cause says
+// what triggered the wake ("login", "status", ...) and who; successful starts are recorded in the wake
+// ledger. It returns the outcome, as counted in mcproxy_wake_requests_total: "started", "running" when
+// ARM says the app is already running (a 409, which isn't a wake of ours to track or charge for), or
+// why not.
+func startAzureContainerApp(ctx context.Context, cause wakeEntry, policies policySet) string {
+	trigger := cause.Trigger
+	ctx, span := startSpan(ctx, "wake", attribute.String("wake.trigger", trigger))
+	defer span.End()
+	log := logger(ctx).With("trigger", trigger)
+	// refuse from the start of the drain, not just once it's waiting for wakes, so status-triggered and
+	// pre-warm wakes don't boot a backend nobody can reach
+	if draining.Load() || !wakeOps.begin() {
+		log.Info("wake skipped: shutting down")
+		metrics.inc("mcproxy_wake_requests_total", "trigger", trigger, "result", "shutdown")
+		return "shutdown"
+	}
+	defer wakeOps.end()
 	// Cooldown to avoid rapid restarts
 	const cooldown = 5 * time.Minute
+	startMu.Lock()
+	if starting {
+		startMu.Unlock()
+		log.Info("wake skipped: start already in progress")
+		metrics.inc("mcproxy_wake_requests_total", "trigger", trigger, "result", "in_progress")
+		return "in_progress"
+	}
 	if time.Since(lastStartTime) < cooldown {
-		log.Printf("startAzureContainerApp: cooldown in effect")
-		return
+		startMu.Unlock()
+		log.Info("wake skipped: cooldown in effect")
+		metrics.inc("mcproxy_wake_requests_total", "trigger", trigger, "result", "cooldown")
+		return "cooldown"
+	}
+	starting = true
+	startMu.Unlock()
+	defer func() {
+		startMu.Lock()
+		starting = false
+		startMu.Unlock()
+	}()
+	if reason := wakeRefusal(cause.Player, policies); reason != "" {
+		log.Info("wake refused", "reason", reason)
+		metrics.inc("mcproxy_wake_requests_total", "trigger", trigger, "result", "refused")
+		return "refused"
 	}
 
 	// Read configuration from environment
@@ -478,32 +704,28 @@ func startAzureContainerApp() {
 	containerAppName := getEnv("AZURE_CONTAINER_APP_NAME", "")
 
 	if subscriptionID == "" || resourceGroup == "" || containerAppName == "" {
-		log.Printf("startAzureContainerApp: Azure config missing; not starting")
-		return
+		log.Warn("wake skipped: Azure config missing")
+		metrics.inc("mcproxy_wake_requests_total", "trigger", trigger, "result", "unconfigured")
+		return "unconfigured"
 	}
 
-	// Acquire Azure credential and token
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	_, ts := startSpan(ctx, "azure.token")
+	token, err := armToken(ctx)
+	endSpan(ts, err)
 	if err != nil {
-		log.Printf("startAzureContainerApp: failed to create credential: %v", err)
-		return
+		log.Error("wake failed: could not get token", "err", err)
+		metrics.inc("mcproxy_wake_requests_total", "trigger", trigger, "result", "error")
+		return "error"
 	}
 
-	ctx := context.Background()
-	token, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureScope}})
-	if err != nil {
-		log.Printf("startAzureContainerApp: failed to get token: %v", err)
-		return
-	}
-
-	url := fmt.Sprintf("https://management.azure.com/subscriptions/%s/resourceGroups/%s/providers/Microsoft.App/containerApps/%s/start?api-version=2025-01-01",
-		subscriptionID, resourceGroup, containerAppName)
+	url := containerAppURL("start")
 
 	client := &http.Client{Timeout: 10 * time.Second}
+	requested := time.Now()
 
 	// Retry with exponential backoff similar to stop logic
 	for attempt := 0; attempt < 3; attempt++ {
-		log.Printf("startAzureContainerApp: attempt %d to start container app", attempt+1)
+		log.Info("starting container app", "attempt", attempt+1)
 
 		if attempt > 0 {
 			time.Sleep(time.Duration(1<<(attempt-1)) * time.Second)
@@ -511,45 +733,113 @@ func startAzureContainerApp() {
 
 		req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
 		if err != nil {
-			log.Printf("startAzureContainerApp: new request failed: %v", err)
+			log.Error("building start request failed", "err", err)
 			continue
 		}
-		req.Header.Set("Authorization", "Bearer "+token.Token)
+		req.Header.Set("Authorization", "Bearer "+token)
 
+		_, as := startSpan(ctx, "arm.start", attribute.Int("attempt", attempt+1))
 		resp, err := client.Do(req)
 		if err != nil {
-			log.Printf("startAzureContainerApp: request failed (attempt %d): %v", attempt+1, err)
+			endSpan(as, err)
+			log.Warn("start request failed", "attempt", attempt+1, "err", err)
 			continue
 		}
 
 		// Read response body for diagnostics then close
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
+		as.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		as.End()
 
-		if (resp.StatusCode >= 200 && resp.StatusCode < 300) || resp.StatusCode == 409 {
-			log.Println("✅ Container app start requested")
-			if len(bodyBytes) > 0 {
-				log.Printf("startAzureContainerApp: response body: %s", strings.TrimSpace(string(bodyBytes)))
-			}
+		if resp.StatusCode == http.StatusConflict {
+			log.Info("container app already running", "body", strings.TrimSpace(string(bodyBytes)))
+			startMu.Lock()
 			lastStartTime = time.Now()
-			return
+			startMu.Unlock()
+			metrics.inc("mcproxy_wake_requests_total", "trigger", trigger, "result", "running")
+			return "running"
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			log.Info("container app start requested", "status", resp.StatusCode, "body", strings.TrimSpace(string(bodyBytes)))
+			startMu.Lock()
+			lastStartTime = time.Now()
+			startMu.Unlock()
+			metrics.inc("mcproxy_wake_requests_total", "trigger", trigger, "result", "started")
+			wakes.begin(ctx, requested)
+			budget.onWake(requested)
+			cause.Time = requested
+			ledger.record(cause)
+			who := cause.Player
+			if who == "" {
+				who = "Someone"
+			}
+			notify.send("wake", "player", who, "trigger", trigger)
+			return "started"
 		}
 
 		// Log client errors (4xx) including body to surface permission details from Azure
-		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != 409 {
-			log.Printf("startAzureContainerApp: client error %d; body: %s; aborting", resp.StatusCode, strings.TrimSpace(string(bodyBytes)))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			log.Error("start rejected, aborting", "status", resp.StatusCode, "body", strings.TrimSpace(string(bodyBytes)))
 			break
 		}
 
 		// For other non-success statuses, log body and retry according to backoff
-		if len(bodyBytes) > 0 {
-			log.Printf("startAzureContainerApp: unexpected status %d; body: %s", resp.StatusCode, strings.TrimSpace(string(bodyBytes)))
-		} else {
-			log.Printf("startAzureContainerApp: unexpected status %d", resp.StatusCode)
-		}
+		log.Warn("unexpected start response", "status", resp.StatusCode, "body", strings.TrimSpace(string(bodyBytes)))
 	}
 
-	log.Printf("startAzureContainerApp: start failed")
+	log.Error("wake failed")
+	span.SetStatus(codes.Error, "start failed")
+	metrics.inc("mcproxy_wake_requests_total", "trigger", trigger, "result", "error")
+	return "error"
+}
+
+// containerAppURL is the ARM URL for action ("start" or "stop") on the backend container app.
+func containerAppURL(action string) string {
+	return fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/Microsoft.App/containerApps/%s/%s?api-version=2025-01-01",
+		strings.TrimSuffix(getEnv("AZURE_ARM_ENDPOINT", "https://management.azure.com"), "/"),
+		getEnv("AZURE_SUBSCRIPTION_ID", ""), getEnv("AZURE_RESOURCE_GROUP", ""), getEnv("AZURE_CONTAINER_APP_NAME", ""), action)
+}
+
+// stopAzureContainerApp asks ARM to stop the backend container app, e.g. after a wake that never
+// became ready, so it isn't left running (and billed) without serving anyone.
+func stopAzureContainerApp(ctx context.Context) error {
+	token, err := armToken(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", containerAppURL("stop"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("stop returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// armToken returns a bearer token for ARM: AZURE_ARM_TOKEN if set (for tests against a fake ARM, with
+// AZURE_ARM_ENDPOINT), otherwise one from the default Azure credential chain.
+func armToken(ctx context.Context) (string, error) {
+	if t := getEnv("AZURE_ARM_TOKEN", ""); t != "" {
+		return t, nil
+	}
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return "", fmt.Errorf("create credential: %w", err)
+	}
+	token, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureScope}})
+	if err != nil {
+		return "", err
+	}
+	return token.Token, nil
 }
 
 // sendDisconnectJSON sends a login Disconnect packet containing a JSON text message.
@@ -568,8 +858,7 @@ func sendDisconnectJSON(conn net.Conn, message string) {
 	pkt = append(pkt, b...)
 
 	// send length prefix and packet
-	writeVarInt(conn, int32(len(pkt)))
-	conn.Write(pkt)
+	conn.Write(append(appendVarInt(nil, int32(len(pkt))), pkt...))
 }
 
 func getEnv(key, defaultValue string) string {
@@ -579,6 +868,26 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvFloat reads a float environment variable, returning defaultValue if unset or invalid.
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err == nil {
+			return f
+		}
+	}
+	return defaultValue
+}
+
+// fmtTemplate substitutes {key} placeholders in tmpl. kv holds alternating keys and values.
+func fmtTemplate(tmpl string, kv ...string) string {
+	pairs := make([]string, 0, len(kv))
+	for i := 0; i+1 < len(kv); i += 2 {
+		pairs = append(pairs, "{"+kv[i]+"}", kv[i+1])
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
+
 // getEnvInt reads an integer environment variable, returning defaultValue if unset or invalid.
 func getEnvInt(key string, defaultValue int) int {
 	if v := os.Getenv(key); v != "" {
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry is a tiny Prometheus text-format registry. The proxy only needs a handful of counters
+// and gauges, which doesn't justify pulling in the full client library.
+type metricsRegistry struct {
+	mu     sync.Mutex
+	help   map[string]string
+	kinds  map[string]string
+	values map[string]map[string]float64 // metric name -> rendered label set -> value
+}
+
+var metrics = &metricsRegistry{
+	help:   map[string]string{},
+	kinds:  map[string]string{},
+	values: map[string]map[string]float64{},
+}
+
+// describe registers HELP/TYPE lines for a metric. kind is "counter" or "gauge".
+func (m *metricsRegistry) describe(name, kind, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kinds[name] = kind
+	m.help[name] = help
+	if m.values[name] == nil {
+		m.values[name] = map[string]float64{}
+	}
+}
+
+// add increments a counter. labels are alternating key/value pairs.
+func (m *metricsRegistry) add(name string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = map[string]float64{}
+	}
+	m.values[name][renderLabels(labels)] += delta
+}
+
+func (m *metricsRegistry) inc(name string, labels ...string) {
+	m.add(name, 1, labels...)
+}
+
+// set stores a gauge value. labels are alternating key/value pairs.
+func (m *metricsRegistry) set(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = map[string]float64{}
+	}
+	m.values[name][renderLabels(labels)] = value
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		if help := m.help[name]; help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		}
+		if kind := m.kinds[name]; kind != "" {
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		}
+		series := make([]string, 0, len(m.values[name]))
+		for labels := range m.values[name] {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+		for _, labels := range series {
+			fmt.Fprintf(w, "%s%s %g\n", name, labels, m.values[name][labels])
+		}
+	}
+}
+
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
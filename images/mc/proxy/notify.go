@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifier posts events to chat webhooks so people know the server is waking without watching it:
+// "wake" (someone is waking the server), "ready", "join" and "leave". The player-monitor sends the
+// matching "sleep" and "shutdown" events.
+//
+// NOTIFY_WEBHOOKS is a comma separated list of [format=]URL, where format is json (the default),
+// discord or slack; Discord and Slack webhook URLs are recognised without one. NOTIFY_EVENTS limits
+// which events are sent, NOTIFY_TEMPLATE_<EVENT> overrides an event's message (placeholders like
+// {player} are the event's fields), and an event about the same player is sent at most once per
+// NOTIFY_DEDUP_S. Failed deliveries are retried NOTIFY_RETRIES times with backoff.
+type notifier struct {
+	targets []webhookTarget
+	events  map[string]bool // nil sends every event
+	dedup   time.Duration
+	retries int
+	backoff time.Duration
+	client  *http.Client
+	queue   chan notification
+
+	mu   sync.Mutex
+	sent map[string]time.Time // dedup key -> last sent
+}
+
+type webhookTarget struct {
+	format string // json, discord or slack
+	url    string
+}
+
+// notification is one event, rendered.
+type notification struct {
+	Event  string            `json:"event"`
+	Text   string            `json:"text"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   time.Time         `json:"time"`
+	Source string            `json:"source"`
+}
+
+var notify *notifier
+
+var notifyTemplates = map[string]string{
+	"wake":  "{player} is waking the server",
+	"ready": "The server is ready (took {took})",
+	"join":  "{player} joined",
+	"leave": "{player} left after {duration}",
+}
+
+func newNotifier() *notifier {
+	spec := getEnv("NOTIFY_WEBHOOKS", "")
+	if spec == "" {
+		return nil
+	}
+	n := &notifier{
+		dedup:   time.Duration(getEnvInt("NOTIFY_DEDUP_S", 60)) * time.Second,
+		retries: getEnvInt("NOTIFY_RETRIES", 3),
+		backoff: time.Second,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan notification, 100),
+		sent:    map[string]time.Time{},
+	}
+	for _, entry := range splitList(spec) {
+		t := parseWebhook(entry)
+		if t.format != "json" && t.format != "discord" && t.format != "slack" {
+			slog.Warn("unknown webhook format, sending json", "format", t.format)
+			t.format = "json"
+		}
+		n.targets = append(n.targets, t)
+	}
+	if events := splitList(getEnv("NOTIFY_EVENTS", "")); len(events) > 0 {
+		n.events = map[string]bool{}
+		for _, e := range events {
+			n.events[strings.ToLower(e)] = true
+		}
+	}
+	metrics.describe("mcproxy_notifications_total", "counter", "Webhook notifications by event and result.")
+	slog.Info("webhook notifications enabled", "webhooks", len(n.targets), "events", getEnv("NOTIFY_EVENTS", "all"))
+	go n.run()
+	return n
+}
+
+// parseWebhook parses a NOTIFY_WEBHOOKS entry, [format=]URL.
+func parseWebhook(entry string) webhookTarget {
+	if format, url, ok := strings.Cut(entry, "="); ok && !strings.Contains(format, "/") {
+		return webhookTarget{format: strings.ToLower(format), url: url}
+	}
+	switch {
+	case strings.Contains(entry, "discord.com/api/webhooks/") || strings.Contains(entry, "discordapp.com/api/webhooks/"):
+		return webhookTarget{format: "discord", url: entry}
+	case strings.Contains(entry, "hooks.slack.com/"):
+		return webhookTarget{format: "slack", url: entry}
+	}
+	return webhookTarget{format: "json", url: entry}
+}
+
+// send renders event with fields (alternating keys and values) and queues it for delivery, unless the
+// event is filtered out or the same one was sent recently. It never blocks.
+func (n *notifier) send(event string, kv ...string) {
+	if n == nil || (n.events != nil && !n.events[event]) {
+		return
+	}
+	fields := map[string]string{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields[kv[i]] = kv[i+1]
+	}
+
+	now := time.Now()
+	key := event + "|" + strings.ToLower(fields["player"])
+	n.mu.Lock()
+	if now.Sub(n.sent[key]) < n.dedup {
+		n.mu.Unlock()
+		metrics.inc("mcproxy_notifications_total", "event", event, "result", "duplicate")
+		return
+	}
+	n.sent[key] = now
+	for k, t := range n.sent {
+		if now.Sub(t) >= n.dedup {
+			delete(n.sent, k)
+		}
+	}
+	n.mu.Unlock()
+
+	tmpl := getEnv("NOTIFY_TEMPLATE_"+strings.ToUpper(event), notifyTemplates[event])
+	msg := notification{Event: event, Text: fmtTemplate(tmpl, kv...), Fields: fields, Time: now, Source: "mc-proxy"}
+	select {
+	case n.queue <- msg:
+	default:
+		slog.Warn("notification queue full, dropping", "event", event)
+		metrics.inc("mcproxy_notifications_total", "event", event, "result", "dropped")
+	}
+}
+
+func (n *notifier) run() {
+	for msg := range n.queue {
+		for _, t := range n.targets {
+			result := "sent"
+			if err := n.deliver(t, msg); err != nil {
+				slog.Warn("notification failed", "event", msg.Event, "format", t.format, "err", err)
+				result = "error"
+			}
+			metrics.inc("mcproxy_notifications_total", "event", msg.Event, "result", result)
+		}
+	}
+}
+
+// deliver posts msg to t, retrying network errors, 5xx and 429 responses. A 429's Retry-After (as
+// Discord sends) is honoured up to 30s.
+func (n *notifier) deliver(t webhookTarget, msg notification) error {
+	body := webhookPayload(t.format, msg)
+	var err error
+	for attempt := 0; attempt <= n.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(n.backoff << (attempt - 1))
+		}
+		var resp *http.Response
+		resp, err = n.client.Post(t.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("webhook returned %s", resp.Status)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if s, perr := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); perr == nil {
+				time.Sleep(min(time.Duration(s*float64(time.Second)), 30*time.Second))
+			}
+			continue
+		}
+		if resp.StatusCode < 500 {
+			return err
+		}
+	}
+	return err
+}
+
+// slackEscaper escapes the characters Slack treats as markup, so a player named "<!channel>" is just text.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// webhookPayload renders msg for a webhook format: Discord and Slack take the text as their message;
+// json gets the whole event. Player names are whatever the client sent, so chat formats are told not to
+// turn them into mentions.
+func webhookPayload(format string, msg notification) []byte {
+	var v any = msg
+	switch format {
+	case "discord":
+		v = map[string]any{"content": msg.Text, "allowed_mentions": map[string][]string{"parse": {}}}
+	case "slack":
+		v = map[string]string{"text": slackEscaper.Replace(msg.Text)}
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseWebhook(t *testing.T) {
+	for entry, want := range map[string]webhookTarget{
+		"https://example.com/hook":                   {"json", "https://example.com/hook"},
+		"https://discord.com/api/webhooks/1/abc":     {"discord", "https://discord.com/api/webhooks/1/abc"},
+		"https://hooks.slack.com/services/T/B/x":     {"slack", "https://hooks.slack.com/services/T/B/x"},
+		"slack=https://chat.example.com/hook?a=b":    {"slack", "https://chat.example.com/hook?a=b"},
+		"https://example.com/hook?token=abc":         {"json", "https://example.com/hook?token=abc"},
+		"DISCORD=https://proxy.example.com/relay/42": {"discord", "https://proxy.example.com/relay/42"},
+	} {
+		if got := parseWebhook(entry); got != want {
+			t.Errorf("parseWebhook(%q) = %+v, want %+v", entry, got, want)
+		}
+	}
+}
+
+func TestNotifyPayloadsAndDedup(t *testing.T) {
+	bodies := make(chan map[string]any, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]any
+		json.NewDecoder(r.Body).Decode(&v)
+		bodies <- v
+	}))
+	defer srv.Close()
+
+	t.Setenv("NOTIFY_TEMPLATE_JOIN", "{player} hopped on")
+	n := &notifier{
+		targets: []webhookTarget{{"discord", srv.URL}, {"slack", srv.URL}, {"json", srv.URL}},
+		dedup:   time.Minute,
+		client:  srv.Client(),
+		queue:   make(chan notification, 10),
+		sent:    map[string]time.Time{},
+	}
+	go n.run()
+	defer close(n.queue)
+
+	n.send("join", "player", "Alice")
+	n.send("join", "player", "alice") // duplicate
+	want := []string{"content", "text", "text"}
+	for i := range want {
+		select {
+		case v := <-bodies:
+			if v[want[i]] != "Alice hopped on" {
+				t.Errorf("payload %d = %v, want %s %q", i, v, want[i], "Alice hopped on")
+			}
+			if i == 2 && (v["event"] != "join" || v["fields"].(map[string]any)["player"] != "Alice") {
+				t.Errorf("json payload = %v, want the event and its fields", v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the notification")
+		}
+	}
+	select {
+	case v := <-bodies:
+		t.Errorf("duplicate notification delivered: %v", v)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		wantHits int32
+	}{
+		{"server error then ok", []int{500, 502, 204}, false, 3},
+		{"rate limited then ok", []int{429, 200}, false, 2},
+		{"client error", []int{400}, true, 1},
+		{"gives up", []int{500, 500, 500, 500, 500}, true, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				i := int(hits.Add(1)) - 1
+				if tc.statuses[i] == 429 {
+					w.Header().Set("Retry-After", "0.01")
+				}
+				w.WriteHeader(tc.statuses[i])
+			}))
+			defer srv.Close()
+
+			n := &notifier{retries: 2, backoff: time.Millisecond, client: srv.Client()}
+			err := n.deliver(webhookTarget{"json", srv.URL}, notification{Event: "ready", Text: "ready"})
+			if (err != nil) != tc.wantErr || hits.Load() != tc.wantHits {
+				t.Errorf("err %v after %d attempts, want error %v after %d", err, hits.Load(), tc.wantErr, tc.wantHits)
+			}
+		})
+	}
+}
+
+func TestWebhookPayloadMentions(t *testing.T) {
+	msg := notification{Event: "wake", Text: "@everyone <!channel> & co is waking the server"}
+	var discord struct {
+		Content         string `json:"content"`
+		AllowedMentions struct {
+			Parse []string `json:"parse"`
+		} `json:"allowed_mentions"`
+	}
+	raw := webhookPayload("discord", msg)
+	if err := json.Unmarshal(raw, &discord); err != nil {
+		t.Fatal(err)
+	}
+	if discord.Content != msg.Text || discord.AllowedMentions.Parse == nil || len(discord.AllowedMentions.Parse) != 0 {
+		t.Errorf("discord payload %s, want the text with no mentions allowed", raw)
+	}
+	var slack struct {
+		Text string `json:"text"`
+	}
+	json.Unmarshal(webhookPayload("slack", msg), &slack)
+	if want := "@everyone &lt;!channel&gt; &amp; co is waking the server"; slack.Text != want {
+		t.Errorf("slack text %q, want %q", slack.Text, want)
+	}
+}
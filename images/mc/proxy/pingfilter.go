@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pingFilter turns away logins from IPs that haven't completed a status ping recently. Real clients
+// nearly always ping from the server list before joining; simple bots connect straight to login. It is
+// opt-in (PING_FILTER=1). Known players skip it: those named in PING_FILTER_KNOWN_PLAYERS and anyone
+// the access log shows reaching the backend before.
+type pingFilter struct {
+	window  time.Duration
+	maxIPs  int
+	message string
+	known   map[string]bool
+
+	mu     sync.Mutex
+	pinged map[string]time.Time // IP -> last completed status ping
+}
+
+var pingCheck *pingFilter
+
+func newPingFilter() *pingFilter {
+	if getEnv("PING_FILTER", "0") != "1" {
+		return nil
+	}
+	f := &pingFilter{
+		window:  time.Duration(getEnvInt("PING_FILTER_WINDOW_M", 10)) * time.Minute,
+		maxIPs:  getEnvInt("PING_FILTER_MAX_IPS", 10000),
+		message: getEnv("PING_FILTER_MESSAGE", "§ePlease refresh your server list and try again."),
+		known:   map[string]bool{},
+		pinged:  map[string]time.Time{},
+	}
+	for _, name := range splitList(getEnv("PING_FILTER_KNOWN_PLAYERS", "")) {
+		f.known[strings.ToLower(name)] = true
+	}
+	metrics.describe("mcproxy_ping_filter_refusals_total", "counter", "Logins turned away for not pinging the server list first.")
+	slog.Info("ping-before-join filter enabled", "window", f.window, "max_ips", f.maxIPs, "known_players", len(f.known))
+	return f
+}
+
+// onPing records that ip completed a status ping (status and ping-pong).
+func (f *pingFilter) onPing(ip string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if _, ok := f.pinged[ip]; !ok && len(f.pinged) >= f.maxIPs {
+		f.evict(now)
+	}
+	f.pinged[ip] = now
+}
+
+// evict makes room in the table: expired entries go first and, if that's not enough (a flood of
+// pings from many addresses), the oldest one. Callers hold f.mu.
+func (f *pingFilter) evict(now time.Time) {
+	var oldest string
+	for ip, t := range f.pinged {
+		if now.Sub(t) >= f.window {
+			delete(f.pinged, ip)
+		} else if oldest == "" || t.Before(f.pinged[oldest]) {
+			oldest = ip
+		}
+	}
+	if len(f.pinged) >= f.maxIPs {
+		delete(f.pinged, oldest)
+	}
+}
+
+// refusal returns the disconnect message for a login by player from ip, or "" to let it through.
+func (f *pingFilter) refusal(ip, player string) string {
+	if f == nil {
+		return ""
+	}
+	f.mu.Lock()
+	t, ok := f.pinged[ip]
+	if ok && time.Since(t) >= f.window {
+		delete(f.pinged, ip)
+		ok = false
+	}
+	f.mu.Unlock()
+	if ok || f.known[strings.ToLower(player)] || (player != "" && sessions.hasPlayed(player)) {
+		return ""
+	}
+	return f.message
+}
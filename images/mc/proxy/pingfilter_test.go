@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPingFilterTableIsBounded(t *testing.T) {
+	f := &pingFilter{window: time.Minute, maxIPs: 3, message: "refresh", known: map[string]bool{}, pinged: map[string]time.Time{}}
+	f.pinged["10.0.0.1"] = time.Now().Add(-2 * time.Minute) // expired
+	f.onPing("10.0.0.2")
+	f.onPing("10.0.0.3")
+	f.onPing("10.0.0.4") // full: the expired entry makes room
+	if _, ok := f.pinged["10.0.0.1"]; ok || len(f.pinged) != 3 {
+		t.Fatalf("table %v, want the expired entry evicted", f.pinged)
+	}
+	for i := 5; i < 100; i++ {
+		f.onPing(fmt.Sprintf("10.0.0.%d", i))
+	}
+	if len(f.pinged) != 3 {
+		t.Fatalf("table grew to %d entries, want 3", len(f.pinged))
+	}
+	if f.refusal("10.0.0.99", "") != "" {
+		t.Error("the most recent ping was evicted")
+	}
+	if f.refusal("10.0.0.2", "") == "" {
+		t.Error("the oldest ping survived a full table")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// prewarmState is what the pre-warm scheduler persists between restarts.
+type prewarmState struct {
+	SessionStarts []time.Time `json:"session_starts"`
+	Wakes         []time.Time `json:"wakes"` // predicted wakes that started the backend, for the weekly cap
+}
+
+// prewarmer learns which weekly time slots usually have players from recorded session start times and
+// wakes the backend a little before those slots begin, at most PREWARM_WEEKLY_CAP times a week. Manual
+// "always up" windows (PREWARM_SCHEDULE) are honoured on top of the learned slots; an operator asked
+// for those explicitly, so they're exempt from the cap and don't count towards it.
+type prewarmer struct {
+	path          string
+	loc           *time.Location
+	slot          time.Duration
+	lead          time.Duration
+	lookbackWeeks int
+	minRatio      float64
+	weeklyCap     int
+	overrides     []weeklyWindow
+
+	mu        sync.Mutex
+	state     prewarmState
+	lastSlot  time.Time // start of the last slot we pre-warmed for, so a slot wakes at most once
+	predicted map[int]bool
+}
+
+var prewarm *prewarmer
+
+func newPrewarmer() *prewarmer {
+	// slots tile a day exactly, so slotStart can count them from midnight
+	slot := getEnvInt("PREWARM_SLOT_MIN", 30)
+	if slot <= 0 || 24*60%slot != 0 {
+		slog.Warn("PREWARM_SLOT_MIN must divide a day into whole slots, using 30", "value", slot)
+		slot = 30
+	}
+	p := &prewarmer{
+		path:          statePath("PREWARM_STATE_PATH", "prewarm.json"),
+		loc:           scheduleLocation(),
+		slot:          time.Duration(slot) * time.Minute,
+		lead:          time.Duration(getEnvInt("PREWARM_LEAD_MIN", 10)) * time.Minute,
+		lookbackWeeks: getEnvInt("PREWARM_LOOKBACK_WEEKS", 6),
+		minRatio:      float64(getEnvInt("PREWARM_MIN_PERCENT", 50)) / 100,
+		weeklyCap:     getEnvInt("PREWARM_WEEKLY_CAP", 5),
+	}
+	if spec := getEnv("PREWARM_SCHEDULE", ""); spec != "" {
+		ws, err := parseWindows(spec)
+		if err != nil {
+			slog.Warn("invalid PREWARM_SCHEDULE", "err", err)
+		}
+		p.overrides = ws
+	}
+	if err := loadJSONFile(p.path, &p.state); err != nil {
+		slog.Error("prewarm: failed to load state", "path", p.path, "err", err)
+	}
+	p.mu.Lock()
+	p.predicted = p.learn(time.Now())
+	p.mu.Unlock()
+	return p
+}
+
+// recordSessionStart remembers that a player joined at t. Recording happens even when pre-warming is
+// disabled so there's history to learn from once it's turned on.
+func (p *prewarmer) recordSessionStart(t time.Time) {
+	p.mu.Lock()
+	p.state.SessionStarts = append(p.state.SessionStarts, t)
+	p.prune(t)
+	p.predicted = p.learn(t)
+	state := p.snapshot()
+	p.mu.Unlock()
+	if err := saveJSONFile(p.path, state); err != nil {
+		slog.Error("prewarm: failed to save state", "path", p.path, "err", err)
+	}
+}
+
+// run checks once a minute whether the backend should be up shortly and wakes it if so.
+func (p *prewarmer) run() {
+	slog.Info("prewarm enabled", "slot", p.slot, "lead", p.lead, "lookback_weeks", p.lookbackWeeks,
+		"min_percent", p.minRatio*100, "weekly_cap", p.weeklyCap, "overrides", len(p.overrides))
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.tick(time.Now())
+	}
+}
+
+func (p *prewarmer) tick(now time.Time) {
+	now = now.In(p.loc)
+	ahead := now.Add(p.lead)
+
+	override := inWindows(p.overrides, now) || inWindows(p.overrides, ahead)
+	p.mu.Lock()
+	slotStart := p.slotStart(ahead)
+	predicted := p.predicted[p.slotIndex(ahead)] && !slotStart.Equal(p.lastSlot)
+	p.mu.Unlock()
+	if !override && !predicted {
+		return
+	}
+
+	if inFlight, _, _ := wakes.progress(); inFlight {
+		return
+	}
+	if _, err := probeBackend(wakes.backendAddr, 2*time.Second); err == nil {
+		return
+	}
+
+	if override {
+		slog.Info("prewarm: inside an always-up window; waking backend")
+		startAzureContainerApp(context.Background(), wakeEntry{Trigger: "schedule"}, allPolicies)
+		return
+	}
+
+	p.mu.Lock()
+	used := p.wakesThisWeek(now)
+	p.lastSlot = slotStart
+	if p.weeklyCap > 0 && used >= p.weeklyCap {
+		p.mu.Unlock()
+		slog.Info("prewarm: weekly cap reached; skipping slot", "cap", p.weeklyCap, "slot", slotStart.Format("Mon 15:04"))
+		metrics.inc("mcproxy_wake_requests_total", "trigger", "schedule", "result", "capped")
+		return
+	}
+	p.mu.Unlock()
+
+	slog.Info("prewarm: players usually around; waking backend", "slot", slotStart.Format("Mon 15:04"), "used", used, "cap", p.weeklyCap)
+	// only a wake that started the backend uses up the cap, not one refused or already under way
+	if startAzureContainerApp(context.Background(), wakeEntry{Trigger: "schedule"}, allPolicies) != "started" {
+		return
+	}
+	p.mu.Lock()
+	p.state.Wakes = append(p.state.Wakes, now)
+	state := p.snapshot()
+	p.mu.Unlock()
+	if err := saveJSONFile(p.path, state); err != nil {
+		slog.Error("prewarm: failed to save state", "path", p.path, "err", err)
+	}
+}
+
+// learn marks a slot as predicted when session starts landed in it during at least minRatio of the
+// observed weeks (and in at least two distinct weeks, so a single late night doesn't count).
+func (p *prewarmer) learn(now time.Time) map[int]bool {
+	if len(p.state.SessionStarts) == 0 {
+		return nil
+	}
+	weeks := int(now.Sub(p.state.SessionStarts[0]).Hours()/(7*24)) + 1
+	weeks = min(weeks, p.lookbackWeeks)
+	if weeks < 2 {
+		return nil
+	}
+	cutoff := now.Add(-time.Duration(p.lookbackWeeks) * 7 * 24 * time.Hour)
+
+	seen := map[int]map[int]bool{} // slot -> set of week numbers
+	for _, t := range p.state.SessionStarts {
+		if t.Before(cutoff) {
+			continue
+		}
+		i := p.slotIndex(t)
+		if seen[i] == nil {
+			seen[i] = map[int]bool{}
+		}
+		seen[i][int(now.Sub(t).Hours()/(7*24))] = true
+	}
+
+	predicted := map[int]bool{}
+	for i, ws := range seen {
+		if len(ws) >= 2 && float64(len(ws))/float64(weeks) >= p.minRatio {
+			predicted[i] = true
+		}
+	}
+	return predicted
+}
+
+// slotIndex numbers the slots of a week starting from Sunday 00:00 in the schedule's location.
+func (p *prewarmer) slotIndex(t time.Time) int {
+	t = t.In(p.loc)
+	minute := int(t.Weekday())*24*60 + t.Hour()*60 + t.Minute()
+	return minute / int(p.slot.Minutes())
+}
+
+func (p *prewarmer) slotStart(t time.Time) time.Time {
+	t = t.In(p.loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, p.loc)
+	perDay := 24 * 60 / int(p.slot.Minutes())
+	return midnight.Add(time.Duration(p.slotIndex(t)%perDay) * p.slot)
+}
+
+func (p *prewarmer) wakesThisWeek(now time.Time) int {
+	y, w := now.In(p.loc).ISOWeek()
+	n := 0
+	for _, t := range p.state.Wakes {
+		if ty, tw := t.In(p.loc).ISOWeek(); ty == y && tw == w {
+			n++
+		}
+	}
+	return n
+}
+
+// prune drops history older than the lookback window.
+func (p *prewarmer) prune(now time.Time) {
+	cutoff := now.Add(-time.Duration(p.lookbackWeeks+1) * 7 * 24 * time.Hour)
+	for len(p.state.SessionStarts) > 0 && p.state.SessionStarts[0].Before(cutoff) {
+		p.state.SessionStarts = p.state.SessionStarts[1:]
+	}
+	for len(p.state.Wakes) > 0 && p.state.Wakes[0].Before(cutoff) {
+		p.state.Wakes = p.state.Wakes[1:]
+	}
+}
+
+func (p *prewarmer) snapshot() prewarmState {
+	return prewarmState{
+		SessionStarts: append([]time.Time(nil), p.state.SessionStarts...),
+		Wakes:         append([]time.Time(nil), p.state.Wakes...),
+	}
+}
+
+// handleAdmin lists the learned slots so operators can see what the scheduler believes.
+func (p *prewarmer) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var slots []string
+	sunday := time.Date(2006, 1, 1, 0, 0, 0, 0, p.loc) // a Sunday
+	for i := 0; i < 7*24*60/int(p.slot.Minutes()); i++ {
+		if p.predicted[i] {
+			slots = append(slots, sunday.Add(time.Duration(i)*p.slot).Format("Mon 15:04"))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"timezone":        p.loc.String(),
+		"predicted_slots": slots,
+		"session_starts":  len(p.state.SessionStarts),
+		"wakes_this_week": p.wakesThisWeek(time.Now()),
+		"weekly_cap":      p.weeklyCap,
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/andreykaipov/infra/images/mc/proxy/internal/mctest"
+)
+
+// setupPrewarm points the shared state at a backend that's down and a fake ARM, and returns a
+// prewarmer that predicts players in the slot starting a lead from now.
+func setupPrewarm(t *testing.T) (*prewarmer, *mctest.ARM) {
+	t.Helper()
+	arm := mctest.NewARM("e2e-token")
+	t.Cleanup(arm.Close)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	// a wake gives up quickly, so it's over before the test ends
+	t.Setenv("WAKE_READY_TIMEOUT_S", "1")
+	t.Setenv("WAKE_POLL_MS", "100")
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "sub")
+	t.Setenv("AZURE_RESOURCE_GROUP", "rg")
+	t.Setenv("AZURE_CONTAINER_APP_NAME", "mc")
+	t.Setenv("AZURE_ARM_ENDPOINT", arm.URL())
+	t.Setenv("AZURE_ARM_TOKEN", "e2e-token")
+	if _, err := setupReplay("", down); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { waitWakes(t) })
+	resetStart := func() {
+		startMu.Lock()
+		lastStartTime, starting = time.Time{}, false
+		startMu.Unlock()
+	}
+	resetStart()
+	t.Cleanup(resetStart)
+
+	p := prewarm
+	p.predicted = map[int]bool{p.slotIndex(time.Now().Add(p.lead)): true}
+	return p, arm
+}
+
+func TestPrewarmCountsOnlyStartedWakes(t *testing.T) {
+	p, arm := setupPrewarm(t)
+
+	// ARM says the app is already running: nothing was started, so the cap isn't used up
+	arm.Status = http.StatusConflict
+	p.tick(time.Now())
+	if n := len(arm.Starts()); n != 1 {
+		t.Fatalf("%d start requests, want 1", n)
+	}
+	if n := p.wakesThisWeek(time.Now()); n != 0 {
+		t.Errorf("%d wakes counted after a 409, want 0", n)
+	}
+
+	// the same slot again, after the cooldown, with a start that goes through
+	arm.Status = 0
+	p.lastSlot = time.Time{}
+	startMu.Lock()
+	lastStartTime = time.Time{}
+	startMu.Unlock()
+	p.tick(time.Now())
+	if n := p.wakesThisWeek(time.Now()); n != 1 {
+		t.Errorf("%d wakes counted after a start, want 1", n)
+	}
+	var saved prewarmState
+	if err := loadJSONFile(p.path, &saved); err != nil || len(saved.Wakes) != 1 {
+		t.Errorf("saved wakes %v (%v), want 1", saved.Wakes, err)
+	}
+	closed := func() bool {
+		budget.mu.Lock()
+		defer budget.mu.Unlock()
+		n := len(budget.state.Periods)
+		return n > 0 && !budget.state.Periods[n-1].End.IsZero()
+	}
+	for deadline := time.Now().Add(5 * time.Second); !closed(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("wake still running after it timed out")
+		}
+	}
+}
+
+func TestPrewarmWeeklyCap(t *testing.T) {
+	p, arm := setupPrewarm(t)
+	p.weeklyCap = 1
+	p.state.Wakes = []time.Time{time.Now()}
+
+	p.tick(time.Now())
+	if starts := arm.Starts(); len(starts) != 0 {
+		t.Errorf("start requests %v with the weekly cap used up", starts)
+	}
+}
+
+func TestPrewarmSlotMinutes(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"15": 15 * time.Minute,
+		"60": time.Hour,
+		"0":  30 * time.Minute,
+		"-5": 30 * time.Minute,
+		"7":  30 * time.Minute, // doesn't divide a day
+	} {
+		t.Setenv("STATE_DIR", t.TempDir())
+		t.Setenv("PREWARM_SLOT_MIN", value)
+		if got := newPrewarmer().slot; got != want {
+			t.Errorf("PREWARM_SLOT_MIN=%s: slot %v, want %v", value, got, want)
+		}
+	}
+}
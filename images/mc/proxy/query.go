@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The UDP query protocol (GameSpy4, enable-query in server.properties) used by server lists and
+// monitoring bots. Every request starts with FE FD, a type byte and a 4-byte session ID the reply
+// echoes. A handshake (type 9) returns a challenge token that stat requests (type 0) must carry; a
+// stat request padded with four extra bytes asks for the full stat instead of the basic one.
+const (
+	queryTypeHandshake = 0x09
+	queryTypeStat      = 0x00
+	queryTokenWindow   = 30 * time.Second // tokens stay valid for one to two windows
+	queryRelayTimeout  = time.Second
+	queryMaxRelays     = 32
+)
+
+// queryResponder answers query requests for one listener. While its backend is up, requests are relayed
+// to the backend's query port if there is one, otherwise answered from the backend's status; while it
+// sleeps, or for backends the proxy doesn't watch, they're answered from synthetic state.
+type queryResponder struct {
+	l      *proxyListener
+	conn   net.PacketConn
+	secret []byte
+	relays chan struct{} // bounds concurrent relays to the backend
+}
+
+// startQueryResponder binds l's query socket, if it has one, and serves it until the returned socket is
+// closed.
+func startQueryResponder(l *proxyListener) (net.PacketConn, error) {
+	if l.Query == "" {
+		return nil, nil
+	}
+	conn, err := net.ListenPacket("udp", l.Query)
+	if err != nil {
+		return nil, err
+	}
+	metrics.describe("mcproxy_query_requests_total", "counter", "Query protocol requests answered, by listener and source.")
+	q := &queryResponder{l: l, conn: conn, secret: make([]byte, 32), relays: make(chan struct{}, queryMaxRelays)}
+	rand.Read(q.secret)
+	slog.Info("query responder listening", "listener", l.Name, "addr", l.Query, "backend_query", l.QueryBackend)
+	go q.run()
+	return conn, nil
+}
+
+func (q *queryResponder) run() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := q.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Warn("query: read failed", "listener", q.l.Name, "err", err)
+			continue
+		}
+		req := append([]byte(nil), buf[:n]...)
+		if len(req) < 7 || req[0] != 0xFE || req[1] != 0xFD {
+			continue
+		}
+		if q.l.QueryBackend != "" && q.l.managed && backend.isUp() {
+			select {
+			case q.relays <- struct{}{}:
+				go func() {
+					defer func() { <-q.relays }()
+					q.relay(req, addr)
+				}()
+			default:
+				metrics.inc("mcproxy_query_requests_total", "listener", q.l.Name, "source", "dropped")
+			}
+			continue
+		}
+		q.answer(req, addr)
+	}
+}
+
+// relay forwards req to the backend's query port and passes the reply back. The challenge token the
+// client gets is the backend's, so if the backend stops answering mid-exchange the client simply has to
+// handshake again, this time with the proxy.
+func (q *queryResponder) relay(req []byte, addr net.Addr) {
+	conn, err := net.DialTimeout("udp", q.l.QueryBackend, queryRelayTimeout)
+	if err == nil {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(queryRelayTimeout))
+		buf := make([]byte, 4096)
+		var n int
+		if _, err = conn.Write(req); err == nil {
+			n, err = conn.Read(buf)
+		}
+		if err == nil {
+			q.conn.WriteTo(buf[:n], addr)
+			metrics.inc("mcproxy_query_requests_total", "listener", q.l.Name, "source", "backend")
+			return
+		}
+	}
+	slog.Debug("query: backend didn't answer, answering locally", "listener", q.l.Name, "err", err)
+	q.answer(req, addr)
+}
+
+// answer replies to req from the proxy's own view of the server.
+func (q *queryResponder) answer(req []byte, addr net.Addr) {
+	typ, session := req[2], req[3:7]
+	ip := remoteIP(addr)
+	reply := []byte{typ}
+	reply = append(reply, session...)
+	switch {
+	case typ == queryTypeHandshake:
+		reply = append(reply, strconv.Itoa(int(q.token(ip, time.Now())))...)
+		reply = append(reply, 0)
+	case typ == queryTypeStat && len(req) >= 11 && q.validToken(ip, int32(binary.BigEndian.Uint32(req[7:11]))):
+		st := q.state()
+		if len(req) >= 15 {
+			reply = st.appendFull(reply)
+		} else {
+			reply = st.appendBasic(reply)
+		}
+	default:
+		// unknown type or a missing/expired token: vanilla stays silent too
+		return
+	}
+	q.conn.WriteTo(reply, addr)
+	metrics.inc("mcproxy_query_requests_total", "listener", q.l.Name, "source", "proxy")
+}
+
+// token derives the challenge token for ip in the window containing at, so nothing needs to be stored
+// per client.
+func (q *queryResponder) token(ip string, at time.Time) int32 {
+	mac := hmac.New(sha256.New, q.secret)
+	mac.Write([]byte(ip))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(at.Unix()/int64(queryTokenWindow/time.Second))))
+	return int32(binary.BigEndian.Uint32(mac.Sum(nil)))
+}
+
+func (q *queryResponder) validToken(ip string, token int32) bool {
+	now := time.Now()
+	return token == q.token(ip, now) || token == q.token(ip, now.Add(-queryTokenWindow))
+}
+
+// queryState is what stat responses report.
+type queryState struct {
+	motd       string
+	version    string
+	numPlayers int
+	maxPlayers int
+	players    []string
+	hostIP     string
+	hostPort   int
+}
+
+// state describes the server as the proxy sees it: the backend's last status while it's up, otherwise
+// the listener's MOTD with no players.
+func (q *queryResponder) state() queryState {
+	host, port, _ := net.SplitHostPort(q.l.Addr)
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	st := queryState{
+		motd:       q.l.description(),
+		version:    "proxy",
+		numPlayers: getEnvInt("PLAYERS_ONLINE", 0),
+		maxPlayers: getEnvInt("PLAYERS_MAX", 0),
+		hostIP:     host,
+	}
+	st.hostPort, _ = strconv.Atoi(port)
+	if !q.l.managed {
+		return st
+	}
+
+	var status struct {
+		Description json.RawMessage `json:"description"`
+		Players     struct {
+			Max    int `json:"max"`
+			Online int `json:"online"`
+			Sample []struct {
+				Name string `json:"name"`
+			} `json:"sample"`
+		} `json:"players"`
+		Version struct {
+			Name string `json:"name"`
+		} `json:"version"`
+	}
+	raw := backend.lastStatus()
+	if raw == nil || json.Unmarshal(raw, &status) != nil {
+		return st
+	}
+	// the version doesn't change while the server sleeps, so report it either way
+	if status.Version.Name != "" {
+		st.version = status.Version.Name
+	}
+	if !backend.isUp() || draining.Load() {
+		return st
+	}
+	st.motd = chatText(status.Description)
+	st.numPlayers, st.maxPlayers = status.Players.Online, status.Players.Max
+	for _, p := range status.Players.Sample {
+		st.players = append(st.players, p.Name)
+	}
+	return st
+}
+
+func (st queryState) appendBasic(b []byte) []byte {
+	for _, s := range []string{st.motd, "SMP", "world", strconv.Itoa(st.numPlayers), strconv.Itoa(st.maxPlayers)} {
+		b = appendCString(b, s)
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(st.hostPort))
+	return appendCString(b, st.hostIP)
+}
+
+func (st queryState) appendFull(b []byte) []byte {
+	b = append(b, "splitnum\x00\x80\x00"...)
+	kv := []string{
+		"hostname", st.motd,
+		"gametype", "SMP",
+		"game_id", "MINECRAFT",
+		"version", st.version,
+		"plugins", "",
+		"map", "world",
+		"numplayers", strconv.Itoa(st.numPlayers),
+		"maxplayers", strconv.Itoa(st.maxPlayers),
+		"hostport", strconv.Itoa(st.hostPort),
+		"hostip", st.hostIP,
+	}
+	for _, s := range kv {
+		b = appendCString(b, s)
+	}
+	b = append(b, 0)
+	b = append(b, "\x01player_\x00\x00"...)
+	for _, p := range st.players {
+		b = appendCString(b, p)
+	}
+	return append(b, 0)
+}
+
+// appendCString appends s NUL-terminated, dropping any NULs inside it.
+func appendCString(b []byte, s string) []byte {
+	return append(append(b, strings.ReplaceAll(s, "\x00", "")...), 0)
+}
+
+// chatText flattens a status description, which is either a plain string or a chat component with
+// nested "extra" components, into legacy text.
+func chatText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var c struct {
+		Text  string            `json:"text"`
+		Extra []json.RawMessage `json:"extra"`
+	}
+	if json.Unmarshal(raw, &c) != nil {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString(c.Text)
+	for _, e := range c.Extra {
+		sb.WriteString(chatText(e))
+	}
+	return sb.String()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startQuery serves a query responder for a listener routing to a backend that's down, and returns a
+// client connected to it.
+func startQuery(t *testing.T, queryBackend string) (*net.UDPConn, *proxyListener) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("MOTD", "e2e MOTD")
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:25565")
+	t.Setenv("PLAYERS_MAX", "20")
+	l, err := setupReplay("", down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Query = "127.0.0.1:0"
+	l.QueryBackend = queryBackend
+	conn, err := startQueryResponder(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, l
+}
+
+// queryRoundTrip sends a query request of type typ carrying payload and returns the reply, or nil if
+// none came.
+func queryRoundTrip(t *testing.T, client *net.UDPConn, typ byte, payload []byte) []byte {
+	t.Helper()
+	req := append([]byte{0xFE, 0xFD, typ, 0, 0, 0, 7}, payload...)
+	if _, err := client.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 4096)
+	n, err := client.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+// queryToken handshakes and returns the challenge token, encoded for a stat request.
+func queryToken(t *testing.T, client *net.UDPConn) []byte {
+	t.Helper()
+	reply := queryRoundTrip(t, client, queryTypeHandshake, nil)
+	if len(reply) < 6 || reply[0] != queryTypeHandshake || !bytes.Equal(reply[1:5], []byte{0, 0, 0, 7}) || reply[len(reply)-1] != 0 {
+		t.Fatalf("handshake reply %q, want the type, session ID and a NUL-terminated token", reply)
+	}
+	token, err := strconv.ParseInt(string(reply[5:len(reply)-1]), 10, 32)
+	if err != nil {
+		t.Fatalf("handshake token %q: %v", reply[5:], err)
+	}
+	return binary.BigEndian.AppendUint32(nil, uint32(int32(token)))
+}
+
+func TestQueryStat(t *testing.T) {
+	client, _ := startQuery(t, "")
+	token := queryToken(t, client)
+
+	if reply := queryRoundTrip(t, client, queryTypeStat, []byte{1, 2, 3, 4}); reply != nil {
+		t.Errorf("answered a stat with a made-up token: %q", reply)
+	}
+
+	basic := queryRoundTrip(t, client, queryTypeStat, token)
+	want := append([]byte{queryTypeStat, 0, 0, 0, 7}, "e2e MOTD\x00SMP\x00world\x000\x0020\x00"...)
+	want = binary.LittleEndian.AppendUint16(want, 25565)
+	want = append(want, "127.0.0.1\x00"...)
+	if !bytes.Equal(basic, want) {
+		t.Errorf("basic stat %q, want %q", basic, want)
+	}
+
+	full := queryRoundTrip(t, client, queryTypeStat, append(token, 0, 0, 0, 0))
+	head := append([]byte{queryTypeStat, 0, 0, 0, 7}, "splitnum\x00\x80\x00hostname\x00e2e MOTD\x00"...)
+	if !bytes.HasPrefix(full, head) {
+		t.Errorf("full stat %q, want it to start %q", full, head)
+	}
+	for _, kv := range []string{"maxplayers\x0020\x00", "hostport\x0025565\x00", "\x00\x01player_\x00\x00"} {
+		if !bytes.Contains(full, []byte(kv)) {
+			t.Errorf("full stat %q is missing %q", full, kv)
+		}
+	}
+}
+
+func TestQueryTokenExpiry(t *testing.T) {
+	q := &queryResponder{secret: []byte("secret")}
+	now := time.Now()
+	if !q.validToken("192.0.2.1", q.token("192.0.2.1", now)) {
+		t.Error("rejected the current token")
+	}
+	if !q.validToken("192.0.2.1", q.token("192.0.2.1", now.Add(-queryTokenWindow))) {
+		t.Error("rejected the previous window's token")
+	}
+	if q.validToken("192.0.2.1", q.token("192.0.2.1", now.Add(-2*queryTokenWindow))) {
+		t.Error("accepted a token two windows old")
+	}
+	if q.validToken("192.0.2.2", q.token("192.0.2.1", now)) {
+		t.Error("accepted another address's token")
+	}
+}
+
+func TestQueryRelay(t *testing.T) {
+	be, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := be.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			be.WriteTo(append([]byte("backend:"), buf[:n]...), addr)
+		}
+	}()
+	client, _ := startQuery(t, be.LocalAddr().String())
+
+	// asleep, the proxy answers itself
+	if reply := queryRoundTrip(t, client, queryTypeHandshake, nil); bytes.HasPrefix(reply, []byte("backend:")) {
+		t.Errorf("relayed %q to a backend that's down", reply)
+	}
+
+	backend.observe(time.Now(), []byte(`{"description":"up"}`), nil)
+	reply := queryRoundTrip(t, client, queryTypeHandshake, nil)
+	if want := "backend:\xfe\xfd\x09\x00\x00\x00\x07"; string(reply) != want {
+		t.Errorf("reply %q while the backend is up, want the backend's %q", reply, want)
+	}
+}
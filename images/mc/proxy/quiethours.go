@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// availability restricts wakes to configured windows (WAKE_WINDOWS, in SCHEDULE_TZ), e.g. so the server
+// can't be started on school nights. Outside the windows the MOTD says when the server may wake again
+// and, optionally, a running server is asked to shut down gracefully when a quiet period begins.
+type availability struct {
+	windows     []weeklyWindow
+	loc         *time.Location
+	shutdownURL string
+
+	mu         sync.Mutex
+	wasAllowed bool
+	pending    bool      // a quiet period began with the backend up and it hasn't gone down since
+	signalled  time.Time // when the player-monitor last accepted a shutdown request
+}
+
+// quietShutdownRetry is how long an accepted shutdown request gets to take the backend down before
+// it's sent again.
+const quietShutdownRetry = 5 * time.Minute
+
+var quietHours *availability
+
+func newAvailability() *availability {
+	spec := getEnv("WAKE_WINDOWS", "")
+	if spec == "" {
+		return nil
+	}
+	ws, err := parseWindows(spec)
+	if err != nil {
+		slog.Warn("invalid WAKE_WINDOWS (wakes are not restricted)", "err", err)
+		return nil
+	}
+	a := &availability{
+		windows:     ws,
+		loc:         scheduleLocation(),
+		shutdownURL: getEnv("QUIET_SHUTDOWN_URL", ""),
+	}
+	a.wasAllowed = a.allowed(time.Now())
+	slog.Info("wake windows", "windows", spec, "tz", a.loc.String(), "shutdown_url", a.shutdownURL)
+	return a
+}
+
+func (a *availability) allowed(now time.Time) bool {
+	if a == nil {
+		return true
+	}
+	return inWindows(a.windows, now.In(a.loc))
+}
+
+// refusal renders QUIET_MOTD with {until} set to the next time a wake is allowed: "16:00" later today,
+// otherwise "Mon 16:00".
+func (a *availability) refusal(now time.Time) string {
+	now = now.In(a.loc)
+	until := "later"
+	if next, ok := nextWindowStart(a.windows, now); ok {
+		if next.YearDay() == now.YearDay() && next.Year() == now.Year() {
+			until = next.Format("15:04")
+		} else {
+			until = next.Format("Mon 15:04")
+		}
+	}
+	return fmtTemplate(getEnv("QUIET_MOTD", "§9Server sleeping until {until}"), "until", until)
+}
+
+// run watches for the start of each quiet period and, if the backend is still up at that point, asks the
+// player-monitor at QUIET_SHUTDOWN_URL to shut it down.
+func (a *availability) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.tick(time.Now())
+	}
+}
+
+// tick sends the shutdown request when a quiet period begins with the backend up, and again on later
+// ticks until the backend goes down: a request can fail, or be accepted by a stop that never happens.
+// A backend woken during the quiet period after that (e.g. through a listener without the policy) is
+// left alone.
+func (a *availability) tick(now time.Time) {
+	allowed := a.allowed(now)
+	up := backend.isUp()
+	a.mu.Lock()
+	if a.wasAllowed && !allowed && up {
+		a.pending, a.signalled = true, time.Time{}
+	}
+	if allowed || !up {
+		a.pending = false
+	}
+	if allowed != a.wasAllowed {
+		invalidateStatus() // the MOTD says when the server may wake again
+	}
+	a.wasAllowed = allowed
+	send := a.pending && a.shutdownURL != "" && now.Sub(a.signalled) >= quietShutdownRetry
+	a.mu.Unlock()
+	if !send {
+		return
+	}
+
+	if err := a.signalShutdown(); err != nil {
+		slog.Error("quiet hours: shutdown signal failed, retrying next minute", "err", err)
+		return
+	}
+	a.mu.Lock()
+	a.signalled = now
+	a.mu.Unlock()
+}
+
+func (a *availability) signalShutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	body, _ := json.Marshal(map[string]string{"reason": getEnv("QUIET_SHUTDOWN_REASON", "quiet hours")})
+	req, err := http.NewRequestWithContext(ctx, "POST", a.shutdownURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := getEnv("QUIET_SHUTDOWN_TOKEN", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	slog.Info("quiet hours: asked player-monitor to shut the server down")
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQuietHoursShutdownRetries(t *testing.T) {
+	var requests atomic.Int32
+	var fail atomic.Bool
+	fail.Store(true)
+	monitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if fail.Load() {
+			http.Error(w, "rcon unavailable", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer monitor.Close()
+
+	// a window two days from now, so today is quiet
+	day := time.Now().UTC().AddDate(0, 0, 2).Weekday().String()[:3]
+	t.Setenv("WAKE_WINDOWS", day+" 10:00-11:00")
+	t.Setenv("SCHEDULE_TZ", "UTC")
+	t.Setenv("QUIET_SHUTDOWN_URL", monitor.URL)
+	t.Setenv("STATE_DIR", t.TempDir())
+	if _, err := setupReplay("", "127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	backend.observe(time.Now(), []byte(`{}`), nil)
+	quietHours.wasAllowed = true // as if the quiet period just began
+
+	now := time.Now()
+	for _, step := range []struct {
+		after time.Duration
+		want  int32
+	}{
+		{0, 1},               // refused by the player-monitor
+		{time.Minute, 2},     // retried, and accepted this time
+		{2 * time.Minute, 2}, // the stop gets a while to happen
+		{7 * time.Minute, 3}, // but the backend is still up
+		{8 * time.Minute, 3},
+	} {
+		if step.after == time.Minute {
+			fail.Store(false)
+		}
+		quietHours.tick(now.Add(step.after))
+		if n := requests.Load(); n != step.want {
+			t.Fatalf("%d shutdown requests after %v, want %d", n, step.after, step.want)
+		}
+	}
+
+	// once it's down, a backend woken later in the quiet period stays up
+	backend.observe(time.Now(), nil, errors.New("down"))
+	backend.observe(time.Now(), nil, errors.New("down"))
+	quietHours.tick(now.Add(20 * time.Minute))
+	backend.observe(time.Now(), []byte(`{}`), nil)
+	quietHours.tick(now.Add(30 * time.Minute))
+	if n := requests.Load(); n != 3 {
+		t.Errorf("%d shutdown requests after the backend went down, want 3", n)
+	}
+}
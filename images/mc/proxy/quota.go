@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wakeEntry attributes one backend wake to whoever caused it.
+type wakeEntry struct {
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger"`
+	Player  string    `json:"player,omitempty"`
+	UUID    string    `json:"uuid,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+}
+
+// wakeLedger records every wake with who caused it and enforces per-player daily and weekly wake quotas
+// (WAKE_QUOTA_DAILY / WAKE_QUOTA_WEEKLY, 0 = unlimited). Players in WAKE_QUOTA_EXEMPT are never limited.
+type wakeLedger struct {
+	path   string
+	loc    *time.Location
+	daily  int
+	weekly int
+	exempt map[string]bool
+
+	mu      sync.Mutex
+	entries []wakeEntry
+}
+
+var ledger *wakeLedger
+
+func newWakeLedger() *wakeLedger {
+	l := &wakeLedger{
+		path:   statePath("WAKE_LEDGER_PATH", "wake-ledger.json"),
+		loc:    scheduleLocation(),
+		daily:  getEnvInt("WAKE_QUOTA_DAILY", 0),
+		weekly: getEnvInt("WAKE_QUOTA_WEEKLY", 0),
+		exempt: map[string]bool{},
+	}
+	for _, name := range splitList(getEnv("WAKE_QUOTA_EXEMPT", "")) {
+		l.exempt[strings.ToLower(name)] = true
+	}
+	if err := loadJSONFile(l.path, &l.entries); err != nil {
+		slog.Error("wake ledger: failed to load", "path", l.path, "err", err)
+	}
+	metrics.describe("mcproxy_player_wakes_total", "counter", "Backend wakes attributed to each player since the proxy started.")
+	metrics.describe("mcproxy_wake_quota_refusals_total", "counter", "Logins refused because the player was over their wake quota.")
+	return l
+}
+
+// record appends e to the ledger and persists it. Entries older than 60 days are dropped.
+func (l *wakeLedger) record(e wakeEntry) {
+	l.mu.Lock()
+	l.entries = append(l.entries, e)
+	cutoff := e.Time.AddDate(0, 0, -60)
+	for len(l.entries) > 0 && l.entries[0].Time.Before(cutoff) {
+		l.entries = l.entries[1:]
+	}
+	entries := append([]wakeEntry(nil), l.entries...)
+	l.mu.Unlock()
+
+	if e.Player != "" {
+		metrics.inc("mcproxy_player_wakes_total", "player", e.Player)
+	}
+	if err := saveJSONFile(l.path, entries); err != nil {
+		slog.Error("wake ledger: failed to save", "path", l.path, "err", err)
+	}
+}
+
+// refusal returns a disconnect message if player has used up a quota, naming the limit and when it
+// resets, or "" if the player may wake the server.
+func (l *wakeLedger) refusal(player string, now time.Time) string {
+	if player == "" || l.exempt[strings.ToLower(player)] {
+		return ""
+	}
+	now = now.In(l.loc)
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, l.loc)
+	weekStart := dayStart.AddDate(0, 0, -((int(now.Weekday()) + 6) % 7)) // Monday
+
+	day, week := l.count(player, dayStart), l.count(player, weekStart)
+	var limit, period string
+	var resets time.Time
+	switch {
+	case l.daily > 0 && day >= l.daily:
+		limit, period, resets = fmt.Sprint(l.daily), "today", dayStart.AddDate(0, 0, 1)
+	case l.weekly > 0 && week >= l.weekly:
+		limit, period, resets = fmt.Sprint(l.weekly), "this week", weekStart.AddDate(0, 0, 7)
+	default:
+		return ""
+	}
+	metrics.inc("mcproxy_wake_quota_refusals_total", "player", player)
+	tmpl := getEnv("WAKE_QUOTA_MESSAGE", "§cYou've already woken the server {limit} times {period}.\n§7Your quota resets {resets}.")
+	return fmtTemplate(tmpl, "limit", limit, "period", period, "resets", resets.Format("Mon 15:04"))
+}
+
+func (l *wakeLedger) count(player string, since time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, e := range l.entries {
+		if strings.EqualFold(e.Player, player) && !e.Time.Before(since) {
+			n++
+		}
+	}
+	return n
+}
+
+// handleAdmin returns ledger entries, optionally filtered by ?player= and ?since= (RFC 3339), along
+// with per-player totals for the current day and week.
+func (l *wakeLedger) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	player := r.URL.Query().Get("player")
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "since must be RFC 3339", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	l.mu.Lock()
+	entries := []wakeEntry{}
+	for _, e := range l.entries {
+		if (player == "" || strings.EqualFold(e.Player, player)) && !e.Time.Before(since) {
+			entries = append(entries, e)
+		}
+	}
+	l.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"quota_daily":  l.daily,
+		"quota_weekly": l.weekly,
+		"entries":      entries,
+	})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayGrace is how long a replay keeps the client side open past the captured end of the connection,
+// so the proxy gets to finish whatever it was doing at that point.
+const replayGrace = 500 * time.Millisecond
+
+// replayResult is what a replayed connection produced.
+type replayResult struct {
+	ClientGot  []byte // everything the proxy wrote back to the client
+	BackendGot []byte // everything that reached the backend on connections other than status probes
+}
+
+// replayCapture plays the client side of rec into handleConnection over a loopback connection, with the
+// captured timing, and returns what came back. The backend is whatever l routes to, normally a
+// fakeBackend; setupReplay must have been called.
+func replayCapture(rec captureRecord, l *proxyListener, fb *fakeBackend) (replayResult, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return replayResult{}, err
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return replayResult{}, err
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		return replayResult{}, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server, l)
+		close(done)
+	}()
+	got := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		got <- b
+	}()
+
+	start := time.Now()
+	at := func(ms float64) time.Time { return start.Add(time.Duration(ms * float64(time.Millisecond))) }
+	for _, e := range rec.Events {
+		if e.Dir != "in" || len(e.Data) == 0 {
+			continue
+		}
+		time.Sleep(time.Until(at(e.TMs)))
+		if _, err := client.Write(e.Data); err != nil {
+			break
+		}
+	}
+
+	// keep the connection open as long as the client originally did, unless the proxy hangs up first
+	var res replayResult
+	select {
+	case res.ClientGot = <-got:
+	case <-time.After(time.Until(at(rec.EndMs).Add(replayGrace))):
+		client.Close()
+		res.ClientGot = <-got
+	}
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		return res, errors.New("handleConnection did not return")
+	}
+	res.BackendGot = fb.drain()
+	return res, nil
+}
+
+// fakeBackend is a stand-in Minecraft server for replays and tests. It answers status pings with a
+// fixed response and records everything else sent to it. When down, it accepts connections and closes
+// them straight away, like a container whose server hasn't started yet.
+type fakeBackend struct {
+	ln   net.Listener
+	down bool
+
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	received []byte
+}
+
+func startFakeBackend(down bool) (*fakeBackend, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &fakeBackend{ln: ln, down: down}
+	go f.serve()
+	return f, nil
+}
+
+func (f *fakeBackend) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeBackend) close() { f.ln.Close() }
+
+func (f *fakeBackend) serve() {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer c.Close()
+			f.handle(c)
+		}()
+	}
+}
+
+func (f *fakeBackend) handle(c net.Conn) {
+	if f.down {
+		return
+	}
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	hs, err := readPacket(c)
+	if err != nil {
+		return
+	}
+	if ns, proto, err := parseHandshake(hs); err == nil && ns == 1 {
+		readPacket(c) // Status Request
+		status := fmt.Sprintf(`{"version":{"name":"fake","protocol":%d},"players":{"max":20,"online":0},"description":{"text":"fake backend"}}`, proto)
+		resp := appendVarInt([]byte{0x00}, int32(len(status)))
+		resp = append(resp, status...)
+		c.Write(append(appendVarInt(nil, int32(len(resp))), resp...))
+		if ping, err := readPacket(c); err == nil {
+			c.Write(append(appendVarInt(nil, int32(len(ping))), ping...))
+		}
+		return
+	}
+	rest, _ := io.ReadAll(c)
+	f.mu.Lock()
+	f.received = append(f.received, appendVarInt(nil, int32(len(hs)))...)
+	f.received = append(f.received, hs...)
+	f.received = append(f.received, rest...)
+	f.mu.Unlock()
+}
+
+// drain waits for open backend connections to finish and returns what they received.
+func (f *fakeBackend) drain() []byte {
+	f.wg.Wait()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := f.received
+	f.received = nil
+	return b
+}
+
+// setupReplay initialises the shared state handleConnection needs and returns the listener named name
+// (or the first one) routed to backendAddr. State files go to STATE_DIR as usual.
+func setupReplay(name, backendAddr string) (*proxyListener, error) {
+	loadTimeouts()
+	favicons = loadFavicons()
+	wakes = newWakeTracker(backendAddr)
+	backend = newBackendWatcher(backendAddr)
+	sessions = newSessionLog()
+	prewarm = newPrewarmer()
+	budget = newBudgetGuard()
+	ledger = newWakeLedger()
+	quietHours = newAvailability()
+	statusWakes = newStatusWaker()
+	pingCheck = newPingFilter()
+	notify = newNotifier()
+	auth = newOnlineAuth()
+	ls, err := loadListeners(backendAddr)
+	if err != nil {
+		return nil, err
+	}
+	l := ls[0]
+	for _, c := range ls {
+		if c.Name == name {
+			l = c
+		}
+	}
+	l.Backend, l.managed = backendAddr, true
+	return l, nil
+}
+
+// loadCaptures reads a CAPTURE_FILE.
+func loadCaptures(path string) ([]captureRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var recs []captureRecord
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 4<<20)
+	for sc.Scan() {
+		var r captureRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		recs = append(recs, r)
+	}
+	return recs, sc.Err()
+}
+
+// runReplay implements "proxy replay [-down] [-id ID] CAPTURE_FILE": it replays captured connections
+// against a fake backend and reports whether the proxy still answers the way it did when captured.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	down := fs.Bool("down", false, "replay against a backend that closes connections straight away")
+	id := fs.String("id", "", "only replay the capture with this connection ID")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: proxy replay [-down] [-id ID] CAPTURE_FILE")
+		return 2
+	}
+	recs, err := loadCaptures(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// The replay may run inside the proxy's own container. Replayed logins mustn't start the real
+	// backend, notify anyone or ask the session server, and state goes to a scratch directory rather
+	// than the live wake ledger, budget and access log.
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(k, "AZURE_") || strings.HasPrefix(k, "NOTIFY_") || strings.HasPrefix(k, "ONLINE_AUTH") ||
+			strings.HasSuffix(k, "_PATH") || k == "CAPTURE_FILE" {
+			os.Unsetenv(k)
+		}
+	}
+	dir, err := os.MkdirTemp("", "mc-proxy-replay")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("STATE_DIR", dir)
+	fb, err := startFakeBackend(*down)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer fb.close()
+
+	failed := 0
+	for _, rec := range recs {
+		if *id != "" && rec.ID != *id {
+			continue
+		}
+		l, err := setupReplay(rec.Listener, fb.addr())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		res, err := replayCapture(rec, l, fb)
+		var want []byte
+		for _, e := range rec.Events {
+			if e.Dir == "out" {
+				want = append(want, e.Data...)
+			}
+		}
+		same := bytes.Equal(res.ClientGot, want)
+		verdict := "same as captured"
+		if !same {
+			verdict = "DIFFERENT from captured"
+			failed++
+		}
+		fmt.Printf("%s %s player=%q next_state=%d: client got %d bytes, %s; backend got %d bytes\n",
+			rec.ID, rec.Remote, rec.Username, rec.NextState, len(res.ClientGot), verdict, len(res.BackendGot))
+		if err != nil {
+			fmt.Printf("  error: %v\n", err)
+		}
+		if !same {
+			fmt.Printf("  captured: %q\n  replayed: %q\n", want, res.ClientGot)
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
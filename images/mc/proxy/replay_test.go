@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andreykaipov/infra/images/mc/proxy/internal/mctest"
+)
+
+// TestReplayCaptures replays connections captured from a real proxy run (testdata/captures.jsonl: a
+// server list ping, then a login) and checks the proxy still handles them the same way.
+func TestReplayCaptures(t *testing.T) {
+	recs, err := loadCaptures("testdata/captures.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[0].NextState != 1 || recs[1].NextState != 2 {
+		t.Fatalf("unexpected captures: %+v", recs)
+	}
+	status, login := recs[0], recs[1]
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("MOTD", "Captured MOTD") // what the proxy was running with
+
+	replay := func(t *testing.T, rec captureRecord, down bool) replayResult {
+		fb, err := startFakeBackend(down)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fb.close()
+		l, err := setupReplay(rec.Listener, fb.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := replayCapture(rec, l, fb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	sent := func(rec captureRecord, dir string) []byte {
+		var b []byte
+		for _, e := range rec.Events {
+			if e.Dir == dir {
+				b = append(b, e.Data...)
+			}
+		}
+		return b
+	}
+
+	t.Run("status", func(t *testing.T) {
+		res := replay(t, status, false)
+		if want := sent(status, "out"); !bytes.Equal(res.ClientGot, want) {
+			t.Errorf("status exchange differs from capture:\n got %q\nwant %q", res.ClientGot, want)
+		}
+	})
+
+	t.Run("login", func(t *testing.T) {
+		res := replay(t, login, false)
+		if want := sent(login, "in"); !bytes.Equal(res.BackendGot, want) {
+			t.Errorf("backend got %q, want the client's handshake and Login Start %q", res.BackendGot, want)
+		}
+		if len(res.ClientGot) != 0 {
+			t.Errorf("proxy wrote %q to the client itself", res.ClientGot)
+		}
+	})
+
+	t.Run("login while backend down", func(t *testing.T) {
+		res := replay(t, login, true)
+		if len(res.BackendGot) != 0 {
+			t.Errorf("backend got %q", res.BackendGot)
+		}
+		// Login Disconnect: [length] [0x00] [JSON text]
+		n, m, err := readVarIntFromBytes(res.ClientGot, 0)
+		if err != nil || m+int(n) != len(res.ClientGot) || res.ClientGot[m] != 0x00 {
+			t.Fatalf("client didn't get a single Login Disconnect: %q", res.ClientGot)
+		}
+		if !bytes.Contains(res.ClientGot, []byte("server starts up")) {
+			t.Errorf("disconnect doesn't mention the wake: %q", res.ClientGot)
+		}
+	})
+}
+
+// TestReplayLeavesLiveProxyAlone replays a login against a sleeping backend with the environment of a
+// live proxy and checks nothing real was started, notified or written.
+func TestReplayLeavesLiveProxyAlone(t *testing.T) {
+	arm := mctest.NewARM("")
+	defer arm.Close()
+	var hooks atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hooks.Add(1) }))
+	defer hook.Close()
+	live := t.TempDir()
+	t.Setenv("STATE_DIR", live)
+	t.Setenv("ACCESS_LOG_PATH", live+"/access.jsonl")
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "sub")
+	t.Setenv("AZURE_RESOURCE_GROUP", "rg")
+	t.Setenv("AZURE_CONTAINER_APP_NAME", "mc")
+	t.Setenv("AZURE_ARM_ENDPOINT", arm.URL())
+	t.Setenv("AZURE_ARM_TOKEN", "token")
+	t.Setenv("NOTIFY_WEBHOOKS", hook.URL)
+
+	runReplay([]string{"-down", "-id", "b7b307f36136ffd3", "testdata/captures.jsonl"})
+	waitWakes(t)
+	if starts := arm.Starts(); len(starts) != 0 {
+		t.Errorf("replay sent ARM starts %q", starts)
+	}
+	time.Sleep(100 * time.Millisecond) // notifications are sent in the background
+	if n := hooks.Load(); n != 0 {
+		t.Errorf("replay sent %d notifications", n)
+	}
+	if entries, _ := os.ReadDir(live); len(entries) != 0 {
+		t.Errorf("replay wrote %d files to the live STATE_DIR", len(entries))
+	}
+}
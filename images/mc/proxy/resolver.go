@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Backend addresses are resolved the way Minecraft clients resolve server addresses: "host:port" dials
+// that port on every A/AAAA record of host, and a bare "host" the default port. "srv://host" looks up
+// _minecraft._tcp.host SRV records, cached for their TTL, and falls back to the default port on host;
+// it's opt-in so other addresses never wait on a lookup that finds nothing. Addresses are tried in
+// order, each with its own BACKEND_DIAL_TIMEOUT_MS, so one dead record doesn't use up the whole
+// connect budget.
+var (
+	backendDialTimeout = 2 * time.Second
+	fallbackBackend    string // BACKEND_FALLBACK_ADDR: e.g. a lobby server, used when the backend can't take players
+)
+
+const (
+	defaultMinecraftPort = "25565"
+	defaultBedrockPort   = "19132"
+)
+
+// resolveBackend expands addr into the ordered list of host:port candidates to dial.
+func resolveBackend(ctx context.Context, addr string) ([]string, error) {
+	type target struct{ host, port string }
+	var targets []target
+	if host, ok := strings.CutPrefix(addr, "srv://"); ok {
+		if bedrockMode.Load() {
+			return nil, fmt.Errorf("resolve %s: Bedrock has no SRV records", addr)
+		}
+		srvs, err := srvRecords.lookup(ctx, host)
+		if err != nil {
+			logger(ctx).Debug("SRV lookup failed, using the default port", "backend", addr, "err", err)
+		}
+		for _, srv := range srvs {
+			targets = append(targets, target{srv.Target, strconv.Itoa(int(srv.Port))})
+		}
+		if len(targets) == 0 {
+			targets = []target{{host, defaultMinecraftPort}}
+		}
+	} else if host, port, err := net.SplitHostPort(addr); err == nil {
+		targets = []target{{host, port}}
+	} else if bedrockMode.Load() {
+		targets = []target{{addr, defaultBedrockPort}}
+	} else {
+		targets = []target{{addr, defaultMinecraftPort}}
+	}
+
+	var out []string
+	var lastErr error
+	for _, t := range targets {
+		if ip := net.ParseIP(t.host); ip != nil {
+			out = append(out, net.JoinHostPort(t.host, t.port))
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, t.host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, ip := range ips {
+			out = append(out, net.JoinHostPort(ip.String(), t.port))
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("resolve %s: %w", addr, lastErr)
+	}
+	return out, nil
+}
+
+// dialBackend connects to the first reachable address of addr. timeout bounds each attempt (and is
+// capped at BACKEND_DIAL_TIMEOUT_MS). Failures are returned as dial *net.OpErrors, including failed
+// lookups, so callers can tell "unreachable" from a backend that answered but misbehaved.
+func dialBackend(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 || timeout > backendDialTimeout {
+		timeout = backendDialTimeout
+	}
+	candidates, err := resolveBackend(ctx, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	var lastErr error
+	for _, c := range candidates {
+		d := net.Dialer{Timeout: timeout}
+		conn, err := d.DialContext(ctx, "tcp", c)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		logger(ctx).Debug("backend address unreachable", "backend", addr, "address", c, "err", err)
+	}
+	return nil, lastErr
+}
+
+// backendHostPort returns the host and port to put in a handshake for addr: the configured name, so
+// virtual-host aware backends see what a client would send, and the port actually connected to.
+func backendHostPort(addr string, conn net.Conn) (string, uint16) {
+	host := strings.TrimPrefix(addr, "srv://")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	port := 25565
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		port = tcp.Port
+	}
+	return host, uint16(port)
+}
+
+// srvCache holds SRV lookups until their records' TTL runs out. The standard resolver doesn't report
+// TTLs, so it asks the system's nameservers itself.
+type srvCache struct {
+	servers []string // host:port of nameservers; nil reads /etc/resolv.conf
+
+	mu      sync.Mutex
+	entries map[string]srvEntry
+}
+
+type srvEntry struct {
+	records []*net.SRV
+	expires time.Time
+}
+
+var srvRecords = &srvCache{entries: map[string]srvEntry{}}
+
+// lookup returns the _minecraft._tcp SRV records of host in the order to try them.
+func (c *srvCache) lookup(ctx context.Context, host string) ([]*net.SRV, error) {
+	host = strings.TrimSuffix(host, ".")
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		records, ttl, err := querySRV(ctx, c.nameservers(), "_minecraft._tcp."+host+".")
+		if err != nil {
+			return nil, err
+		}
+		e = srvEntry{records, time.Now().Add(ttl)}
+		c.mu.Lock()
+		c.entries[host] = e
+		c.mu.Unlock()
+	}
+	return orderSRV(e.records), nil
+}
+
+func (c *srvCache) nameservers() []string {
+	if c.servers != nil {
+		return c.servers
+	}
+	var out []string
+	if data, err := os.ReadFile("/etc/resolv.conf"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if f := strings.Fields(line); len(f) > 1 && f[0] == "nameserver" {
+				out = append(out, net.JoinHostPort(f[1], "53"))
+			}
+		}
+	}
+	if len(out) == 0 {
+		out = []string{"127.0.0.1:53"}
+	}
+	return out
+}
+
+// querySRV asks each server in turn for name's SRV records, over TCP if the UDP answer was truncated,
+// and returns them with the lowest of their TTLs.
+func querySRV(ctx context.Context, servers []string, name string) ([]*net.SRV, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Uint32())
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}},
+	}
+	query, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastErr error
+	for _, server := range servers {
+		resp, err := dnsExchange(ctx, "udp", server, query)
+		if err == nil && resp.Truncated {
+			resp, err = dnsExchange(ctx, "tcp", server, query)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.ID != id {
+			lastErr = fmt.Errorf("%s: mismatched DNS reply", server)
+			continue
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess && resp.RCode != dnsmessage.RCodeNameError {
+			lastErr = fmt.Errorf("%s: %s", server, resp.RCode)
+			continue
+		}
+		var records []*net.SRV
+		ttl := time.Duration(math.MaxInt64)
+		for _, a := range resp.Answers {
+			if srv, ok := a.Body.(*dnsmessage.SRVResource); ok {
+				records = append(records, &net.SRV{Target: strings.TrimSuffix(srv.Target.String(), "."), Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight})
+				ttl = min(ttl, time.Duration(a.Header.TTL)*time.Second)
+			}
+		}
+		if len(records) == 0 {
+			return nil, 0, fmt.Errorf("no SRV records for %s", name)
+		}
+		return records, ttl, nil
+	}
+	return nil, 0, lastErr
+}
+
+// dnsExchange sends query to server and reads the reply. Over TCP, messages carry a length prefix.
+func dnsExchange(ctx context.Context, network, server string, query []byte) (*dnsmessage.Message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(backendDialTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	if network == "tcp" {
+		query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(size[:]))
+		_, err = io.ReadFull(conn, buf[:n])
+	} else {
+		n, err = conn.Read(buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// orderSRV sorts records by priority and, within a priority, shuffles them by weight as RFC 2782 asks.
+func orderSRV(records []*net.SRV) []*net.SRV {
+	rest := slices.Clone(records)
+	slices.SortStableFunc(rest, func(a, b *net.SRV) int { return int(a.Priority) - int(b.Priority) })
+	out := make([]*net.SRV, 0, len(rest))
+	for len(rest) > 0 {
+		same := 1
+		for same < len(rest) && rest[same].Priority == rest[0].Priority {
+			same++
+		}
+		group := rest[:same]
+		for len(group) > 0 {
+			total := 0
+			for _, r := range group {
+				total += int(r.Weight)
+			}
+			pick := 0
+			if total > 0 {
+				for n := rand.IntN(total + 1); pick < len(group)-1 && n > int(group[pick].Weight); pick++ {
+					n -= int(group[pick].Weight)
+				}
+			}
+			out = append(out, group[pick])
+			group = slices.Delete(group, pick, pick+1)
+		}
+		rest = rest[same:]
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers every SRV query with one record for localhost:port, and counts the queries.
+func fakeDNS(t *testing.T, port uint16, ttl uint32) (addr string, queries *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	queries = new(atomic.Int32)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if q.Unpack(buf[:n]) != nil || len(q.Questions) != 1 {
+				continue
+			}
+			queries.Add(1)
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: q.ID, Response: true},
+				Questions: q.Questions,
+				Answers: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: ttl},
+					Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName("localhost."), Port: port},
+				}},
+			}
+			out, _ := resp.Pack()
+			conn.WriteTo(out, from)
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+func TestResolveBackendSRV(t *testing.T) {
+	server, queries := fakeDNS(t, 25599, 1)
+	old := srvRecords
+	srvRecords = &srvCache{servers: []string{server}, entries: map[string]srvEntry{}}
+	t.Cleanup(func() { srvRecords = old })
+	ctx := context.Background()
+
+	for addr, want := range map[string]string{
+		"127.0.0.1:25570": "127.0.0.1:25570",
+		"127.0.0.1":       "127.0.0.1:25565",
+	} {
+		got, err := resolveBackend(ctx, addr)
+		if err != nil || !slices.Equal(got, []string{want}) {
+			t.Errorf("resolveBackend(%q) = %v, %v; want [%s]", addr, got, err, want)
+		}
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("%d SRV queries without srv://", n)
+	}
+
+	for range 3 {
+		got, err := resolveBackend(ctx, "srv://mc.example")
+		if err != nil || !slices.Contains(got, "127.0.0.1:25599") {
+			t.Fatalf("resolveBackend(srv://mc.example) = %v, %v; want the SRV record's port on localhost", got, err)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d SRV queries within the TTL, want 1", n)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := resolveBackend(ctx, "srv://mc.example"); err != nil {
+		t.Fatal(err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d SRV queries after the TTL ran out, want 2", n)
+	}
+}
+
+func TestOrderSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "c", Priority: 20, Weight: 0},
+		{Target: "a", Priority: 10, Weight: 0},
+		{Target: "b", Priority: 10, Weight: 100},
+	}
+	seen := map[string]bool{}
+	for range 200 {
+		got := orderSRV(records)
+		if len(got) != 3 || got[2].Target != "c" {
+			t.Fatalf("orderSRV = %v, want the priority 20 record last", got)
+		}
+		seen[got[0].Target] = true
+	}
+	if !seen["b"] {
+		t.Errorf("the weighted record never came first")
+	}
+}
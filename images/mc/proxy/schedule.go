@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the alpine image ships without zoneinfo
+)
+
+// weeklyWindow is a recurring time range such as "Fri 19:00-23:00". Minutes count from local midnight;
+// an end before the start wraps past midnight into the following day.
+type weeklyWindow struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWindows parses a semicolon separated list of windows, e.g.
+// "Mon-Thu 16:00-22:00; Fri 16:00-24:00; Sat,Sun 09:00-23:00".
+func parseWindows(spec string) ([]weeklyWindow, error) {
+	var out []weeklyWindow
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Fields(part)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("window %q: want \"<days> <HH:MM>-<HH:MM>\"", part)
+		}
+		var w weeklyWindow
+		for _, d := range strings.Split(fields[0], ",") {
+			from, to, isRange := strings.Cut(strings.ToLower(d), "-")
+			first, ok := weekdayNames[from[:min(3, len(from))]]
+			if !ok {
+				return nil, fmt.Errorf("window %q: unknown day %q", part, from)
+			}
+			last := first
+			if isRange {
+				if last, ok = weekdayNames[to[:min(3, len(to))]]; !ok {
+					return nil, fmt.Errorf("window %q: unknown day %q", part, to)
+				}
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				w.days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+		from, to, ok := strings.Cut(fields[1], "-")
+		if !ok {
+			return nil, fmt.Errorf("window %q: want a HH:MM-HH:MM time range", part)
+		}
+		var err error
+		if w.start, err = parseClock(from); err != nil {
+			return nil, fmt.Errorf("window %q: %w", part, err)
+		}
+		if w.end, err = parseClock(to); err != nil {
+			return nil, fmt.Errorf("window %q: %w", part, err)
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hh < 0 || hh > 24 || mm < 0 || mm > 59 || (hh == 24 && mm != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hh*60 + mm, nil
+}
+
+// contains reports whether t (already in the schedule's location) falls inside w.
+func (w weeklyWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// wraps midnight: the tail belongs to the previous day's window
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+func inWindows(ws []weeklyWindow, t time.Time) bool {
+	for _, w := range ws {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextWindowStart returns the first minute at or after t that falls inside one of ws, searching up to a
+// week ahead.
+func nextWindowStart(ws []weeklyWindow, t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	for i := 0; i <= 7*24*60; i++ {
+		c := t.Add(time.Duration(i) * time.Minute)
+		if inWindows(ws, c) {
+			return c, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// scheduleLocation returns SCHEDULE_TZ (an IANA name like "America/New_York"), defaulting to UTC.
+func scheduleLocation() *time.Location {
+	name := getEnv("SCHEDULE_TZ", "UTC")
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		slog.Warn("invalid SCHEDULE_TZ; using UTC", "value", name, "err", err)
+		return time.UTC
+	}
+	return loc
+}
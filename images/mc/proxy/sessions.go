@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Close reasons recorded on sessions.
+const (
+	closeClientQuit    = "client_quit"
+	closeBackendClosed = "backend_closed"
+	closeError         = "error"
+	closeDialFailed    = "dial_failed"
+	closeBackendDown   = "backend_down"
+)
+
+// sessionRecord is one line of the access log: a connection the proxy handed to the backend.
+type sessionRecord struct {
+	ID          string    `json:"id"`
+	Listener    string    `json:"listener,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end,omitzero"`
+	DurationMs  int64     `json:"duration_ms"`
+	RemoteIP    string    `json:"remote_ip"`
+	Username    string    `json:"username,omitempty"`
+	UUID        string    `json:"uuid,omitempty"`
+	Protocol    int32     `json:"protocol"`
+	NextState   int       `json:"next_state"`
+	Backend     string    `json:"backend"`
+	BytesUp     int64     `json:"bytes_up"`   // client -> backend
+	BytesDown   int64     `json:"bytes_down"` // backend -> client
+	CloseReason string    `json:"close_reason,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// session is a live connection. Byte counters are updated by the splice goroutines.
+type session struct {
+	rec       sessionRecord
+	conn      net.Conn
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+	closed    atomic.Bool // closed by the proxy shutting down
+}
+
+func (s *session) snapshot() sessionRecord {
+	r := s.rec
+	r.BytesUp = s.bytesUp.Load()
+	r.BytesDown = s.bytesDown.Load()
+	if r.End.IsZero() {
+		r.DurationMs = time.Since(r.Start).Milliseconds()
+	}
+	return r
+}
+
+// sessionLog writes finished sessions to a JSON-lines access log and keeps the most recent ones in
+// memory, alongside the active ones, for the admin API.
+type sessionLog struct {
+	path string
+	keep int
+
+	mu     sync.Mutex
+	file   *os.File
+	recent []sessionRecord
+	active map[string]*session
+}
+
+var sessions *sessionLog
+
+func newSessionLog() *sessionLog {
+	l := &sessionLog{
+		path:   statePath("ACCESS_LOG_PATH", "access.jsonl"),
+		keep:   getEnvInt("SESSION_HISTORY_SIZE", 1000),
+		active: map[string]*session{},
+	}
+	l.loadRecent()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		slog.Error("access log: cannot create directory", "err", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		slog.Error("access log: failed to open (sessions kept in memory only)", "path", l.path, "err", err)
+	} else {
+		l.file = f
+	}
+	metrics.describe("mcproxy_sessions_total", "counter", "Proxied connections by listener and close reason.")
+	metrics.describe("mcproxy_session_bytes_total", "counter", "Bytes spliced between clients and the backend.")
+	metrics.describe("mcproxy_sessions_active", "gauge", "Connections currently being proxied.")
+	return l
+}
+
+// loadRecent seeds the in-memory history from the tail of an existing access log.
+func (l *sessionLog) loadRecent() {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r sessionRecord
+		if json.Unmarshal(sc.Bytes(), &r) == nil {
+			l.recent = append(l.recent, r)
+			if len(l.recent) > l.keep {
+				l.recent = l.recent[1:]
+			}
+		}
+	}
+}
+
+func (l *sessionLog) start(conn net.Conn, backendAddr string, info clientInfo) *session {
+	s := &session{rec: sessionRecord{
+		ID:        info.connID,
+		Listener:  info.listener,
+		Start:     time.Now(),
+		RemoteIP:  remoteIP(conn.RemoteAddr()),
+		Username:  info.username,
+		UUID:      info.uuid,
+		Protocol:  info.protocol,
+		NextState: info.nextState,
+		Backend:   backendAddr,
+	}, conn: conn}
+	l.mu.Lock()
+	l.active[s.rec.ID] = s
+	metrics.set("mcproxy_sessions_active", float64(len(l.active)))
+	l.mu.Unlock()
+	return s
+}
+
+// finish closes out s with reason (and err, if any) and appends it to the access log.
+func (l *sessionLog) finish(s *session, reason string, err error) {
+	if s.closed.Load() {
+		reason, err = closeShutdown, nil
+	}
+	// s.rec is read under l.mu by the admin API for as long as s is active
+	l.mu.Lock()
+	delete(l.active, s.rec.ID)
+	metrics.set("mcproxy_sessions_active", float64(len(l.active)))
+	s.rec.End = time.Now()
+	s.rec.DurationMs = s.rec.End.Sub(s.rec.Start).Milliseconds()
+	s.rec.CloseReason = reason
+	if err != nil {
+		s.rec.Error = err.Error()
+	}
+	rec := s.snapshot()
+	l.recent = append(l.recent, rec)
+	if len(l.recent) > l.keep {
+		l.recent = l.recent[len(l.recent)-l.keep:]
+	}
+	if l.file != nil {
+		line, _ := json.Marshal(rec)
+		if _, err := l.file.Write(append(line, '\n')); err != nil {
+			slog.Error("access log: write failed", "err", err)
+		}
+	}
+	l.mu.Unlock()
+
+	metrics.inc("mcproxy_sessions_total", "listener", rec.Listener, "reason", reason)
+	metrics.add("mcproxy_session_bytes_total", float64(rec.BytesUp), "direction", "up")
+	metrics.add("mcproxy_session_bytes_total", float64(rec.BytesDown), "direction", "down")
+}
+
+// setBackend records which backend s ended up on, e.g. the fallback.
+func (l *sessionLog) setBackend(s *session, addr string) {
+	l.mu.Lock()
+	s.rec.Backend = addr
+	l.mu.Unlock()
+}
+
+// hasPlayed reports whether player has a recent session that got through to a backend.
+func (l *sessionLog) hasPlayed(player string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.recent {
+		if r.NextState == 2 && r.BytesDown > 0 && strings.EqualFold(r.Username, player) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastSeen returns up to n players' most recent sessions that got through to a backend, most recent
+// first.
+func (l *sessionLog) lastSeen(n int) []sessionRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []sessionRecord
+	seen := map[string]bool{}
+	for i := len(l.recent) - 1; i >= 0 && len(out) < n; i-- {
+		r := l.recent[i]
+		key := strings.ToLower(r.Username)
+		if r.NextState != 2 || r.BytesDown == 0 || r.Username == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, r)
+	}
+	return out
+}
+
+func (l *sessionLog) activeCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.active)
+}
+
+// closeAll closes every active client connection and returns how many there were. Their splices
+// then return and record the session as closed by shutdown.
+func (l *sessionLog) closeAll() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.active {
+		s.closed.Store(true)
+		s.conn.Close()
+	}
+	return len(l.active)
+}
+
+// handleAdmin lists sessions, newest first. Filters: ?player=, ?ip=, ?since= (RFC 3339), ?limit=
+// (default 100) and ?active=1 for only the connections currently open.
+func (l *sessionLog) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "since must be RFC 3339", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	match := func(rec sessionRecord) bool {
+		return (q.Get("player") == "" || strings.EqualFold(rec.Username, q.Get("player"))) &&
+			(q.Get("ip") == "" || rec.RemoteIP == q.Get("ip")) &&
+			!rec.Start.Before(since)
+	}
+
+	out := []sessionRecord{}
+	l.mu.Lock()
+	for _, s := range l.active {
+		if rec := s.snapshot(); match(rec) {
+			out = append(out, rec)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.After(out[j].Start) })
+	if q.Get("active") != "1" {
+		for i := len(l.recent) - 1; i >= 0; i-- {
+			if match(l.recent[i]) {
+				out = append(out, l.recent[i])
+			}
+		}
+	}
+	l.mu.Unlock()
+	if len(out) > limit {
+		out = out[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// countingWriter adds every byte written through it to n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
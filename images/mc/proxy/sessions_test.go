@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// TestSessionAdminWhileFinishing lists sessions while they're being finished; run with -race.
+func TestSessionAdminWhileFinishing(t *testing.T) {
+	t.Setenv("STATE_DIR", t.TempDir())
+	l := newSessionLog()
+	defer l.file.Close()
+
+	const n = 50
+	var live []*session
+	for i := range n {
+		c, peer := net.Pipe()
+		defer c.Close()
+		defer peer.Close()
+		live = append(live, l.start(c, "backend:25565", clientInfo{connID: fmt.Sprint(i), nextState: 2, username: "alice"}))
+	}
+
+	done := make(chan struct{})
+	var lister, finishers sync.WaitGroup
+	lister.Add(1)
+	go func() {
+		defer lister.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			rec := httptest.NewRecorder()
+			l.handleAdmin(rec, httptest.NewRequest("GET", "/admin/sessions?limit=1000", nil))
+			if rec.Code != 200 {
+				t.Errorf("admin sessions returned %d", rec.Code)
+				return
+			}
+		}
+	}()
+	for _, s := range live {
+		finishers.Add(1)
+		go func() {
+			defer finishers.Done()
+			l.setBackend(s, "fallback:25565")
+			l.finish(s, closeClientQuit, nil)
+		}()
+	}
+	finishers.Wait()
+	close(done)
+	lister.Wait()
+
+	rec := httptest.NewRecorder()
+	l.handleAdmin(rec, httptest.NewRequest("GET", "/admin/sessions?limit=1000", nil))
+	var out []sessionRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != n {
+		t.Fatalf("%d sessions listed, want %d", len(out), n)
+	}
+	for _, r := range out {
+		if r.End.IsZero() || r.CloseReason != closeClientQuit || r.Backend != "fallback:25565" {
+			t.Errorf("session %s recorded as %+v", r.ID, r)
+		}
+	}
+}
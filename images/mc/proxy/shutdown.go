@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const closeShutdown = "proxy_shutdown"
+
+// draining is set once the proxy has been told to stop. From then on status pings get SHUTDOWN_MOTD,
+// new logins are turned away with SHUTDOWN_MESSAGE and no new wakes are started.
+var draining atomic.Bool
+
+// wakeOps tracks wake requests that are talking to ARM so shutdown can let them finish.
+var wakeOps opGroup
+
+// opGroup is a WaitGroup that can be closed: once closed, begin refuses new operations, so waiting
+// can't race with operations that are just starting.
+type opGroup struct {
+	mu     sync.Mutex
+	n      int
+	closed bool
+	done   chan struct{}
+}
+
+// begin registers an operation, or returns false if the group has been closed.
+func (g *opGroup) begin() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.n++
+	return true
+}
+
+func (g *opGroup) end() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n--
+	if g.n == 0 && g.done != nil {
+		close(g.done)
+		g.done = nil
+	}
+}
+
+// closeAndWait stops new operations and waits up to timeout for running ones. It reports whether they
+// all finished.
+func (g *opGroup) closeAndWait(timeout time.Duration) bool {
+	g.mu.Lock()
+	g.closed = true
+	if g.n == 0 {
+		g.mu.Unlock()
+		return true
+	}
+	if g.done == nil {
+		g.done = make(chan struct{})
+	}
+	done := g.done
+	g.mu.Unlock()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// handleShutdown waits for SIGTERM or SIGINT, drains the proxy and returns once it's safe to exit:
+//
+//  1. Keep answering status pings (with SHUTDOWN_MOTD) and turn away new logins, while players already
+//     connected get up to DRAIN_TIMEOUT_S to leave on their own. Container Apps stops routing new
+//     traffic to the old revision on SIGTERM, so this mostly reaches clients already holding a connection.
+//  2. Stop accepting and close whatever sessions remain. Spliced connections are past login, where the
+//     client and server share compression and possibly encryption state, so the proxy can't inject a
+//     disconnect packet into them. Logins arriving during the drain do get a proper Login Disconnect.
+//  3. Let wake requests already talking to ARM finish, up to WAKE_DRAIN_TIMEOUT_S.
+//
+// A second signal exits immediately.
+func handleShutdown(listeners []io.Closer) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	go func() {
+		<-sigs
+		slog.Warn("second signal, exiting now")
+		os.Exit(1)
+	}()
+
+	drainTimeout := time.Duration(getEnvInt("DRAIN_TIMEOUT_S", 20)) * time.Second
+	slog.Info("draining", "signal", sig.String(), "timeout", drainTimeout, "sessions", sessions.activeCount())
+	draining.Store(true)
+	invalidateStatus()
+
+	deadline := time.Now().Add(drainTimeout)
+	for sessions.activeCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(250 * time.Millisecond)
+	}
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	if n := sessions.closeAll(); n > 0 {
+		slog.Info("drain period over, closed remaining sessions", "sessions", n)
+		// give their splices a moment to return and write the access log
+		for i := 0; i < 20 && sessions.activeCount() > 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	if !wakeOps.closeAndWait(time.Duration(getEnvInt("WAKE_DRAIN_TIMEOUT_S", 30)) * time.Second) {
+		slog.Warn("gave up waiting for in-flight wake requests")
+	}
+	slog.Info("shutdown complete")
+}
+
+// shutdownMessage is the Login Disconnect text for players who connect while the proxy is draining.
+func shutdownMessage() string {
+	return getEnv("SHUTDOWN_MESSAGE", "§eThe proxy is restarting.\n§7Reconnect in a few seconds.")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	closeIdleTimeout = "idle_timeout"
+	closeMaxDuration = "max_duration"
+)
+
+// spliceConfig tunes proxied connections once the backend has been picked.
+type spliceConfig struct {
+	idleTimeout time.Duration // close when neither side has sent anything for this long (0 = never)
+	maxDuration time.Duration // close after this long regardless of activity (0 = never)
+	keepAlive   time.Duration // TCP keepalive period (0 = OS default, <0 = disabled)
+	noDelay     bool
+}
+
+var spliceOpts = spliceConfig{idleTimeout: 2 * time.Minute, noDelay: true}
+
+func loadSpliceConfig() spliceConfig {
+	// Minecraft exchanges keep-alives every 15s in both directions, so a couple of minutes of silence
+	// means one side is gone.
+	return spliceConfig{
+		idleTimeout: time.Duration(getEnvInt("SPLICE_IDLE_TIMEOUT_S", 120)) * time.Second,
+		maxDuration: time.Duration(getEnvInt("SPLICE_MAX_DURATION_S", 0)) * time.Second,
+		keepAlive:   time.Duration(getEnvInt("TCP_KEEPALIVE_S", 30)) * time.Second,
+		noDelay:     getEnv("TCP_NODELAY", "1") == "1",
+	}
+}
+
+// tuneTCP applies keepalive and Nagle settings to conn if it's a TCP connection.
+func (c spliceConfig) tuneTCP(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(c.noDelay)
+	if c.keepAlive < 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAlive(true)
+	if c.keepAlive > 0 {
+		tc.SetKeepAlivePeriod(c.keepAlive)
+	}
+}
+
+var spliceBufs = sync.Pool{New: func() any {
+	b := make([]byte, 32*1024)
+	return &b
+}}
+
+// splice copies between client and backend in both directions until both have finished. prefix holds
+// backend bytes that were already read and is delivered to the client first. When one side finishes
+// sending, the other side's write half is closed so half-closed connections drain properly; an error
+// in either direction tears down both. The returned reason describes whichever direction ended first.
+func (c spliceConfig) splice(client, backend net.Conn, prefix []byte, up, down *atomic.Int64) (string, error) {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	var once sync.Once
+	var reason string
+	var firstErr error
+	finish := func(r string, err error) {
+		once.Do(func() { reason, firstErr = r, err })
+	}
+	abort := func() {
+		client.Close()
+		backend.Close()
+	}
+
+	if c.maxDuration > 0 {
+		t := time.AfterFunc(c.maxDuration, func() {
+			finish(closeMaxDuration, nil)
+			abort()
+		})
+		defer t.Stop()
+	}
+
+	if len(prefix) > 0 {
+		n, err := client.Write(prefix)
+		down.Add(int64(n))
+		if err != nil {
+			abort()
+			return closeError, err
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn, counter *atomic.Int64, eofReason string) {
+		defer wg.Done()
+		err := c.copyIdle(dst, src, counter, &lastActive)
+		switch {
+		case err == nil:
+			finish(eofReason, nil)
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			} else {
+				dst.Close()
+			}
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			finish(closeIdleTimeout, nil)
+			abort()
+		default:
+			finish(closeError, err)
+			abort()
+		}
+	}
+	go pipe(backend, client, up, closeClientQuit)
+	go pipe(client, backend, down, closeBackendClosed)
+	wg.Wait()
+	abort()
+	return reason, firstErr
+}
+
+// copyIdle copies src to dst until EOF. Reads time out after the idle timeout, but only give up if the
+// connection as a whole (either direction, tracked in lastActive) has been quiet that long.
+func (c spliceConfig) copyIdle(dst, src net.Conn, counter, lastActive *atomic.Int64) error {
+	bp := spliceBufs.Get().(*[]byte)
+	defer spliceBufs.Put(bp)
+	buf := *bp
+
+	for {
+		if c.idleTimeout > 0 {
+			src.SetReadDeadline(time.Unix(0, lastActive.Load()).Add(c.idleTimeout))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+			if c.idleTimeout > 0 {
+				dst.SetWriteDeadline(time.Now().Add(c.idleTimeout))
+			}
+			w, werr := dst.Write(buf[:n])
+			counter.Add(int64(w))
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// the other direction may have kept the connection alive in the meantime
+			if time.Since(time.Unix(0, lastActive.Load())) < c.idleTimeout {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
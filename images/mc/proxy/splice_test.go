@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSpliceAbandonedConnections opens thousands of spliced connections whose clients either vanish
+// (close abruptly) or go silent, and checks that every splice returns and nothing leaks.
+func TestSpliceAbandonedConnections(t *testing.T) {
+	conns := 2000
+	if testing.Short() {
+		conns = 200
+	}
+	cfg := spliceConfig{idleTimeout: 300 * time.Millisecond, noDelay: true}
+
+	// backend: accept and hold connections open, echoing nothing
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	go func() {
+		for {
+			c, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+
+	baseGoroutines := runtime.NumGoroutine()
+	baseFDs := openFDs()
+
+	var wg sync.WaitGroup
+	var reasons sync.Map
+	go func() {
+		for {
+			client, err := proxyLn.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				backend, err := net.Dial("tcp", backendLn.Addr().String())
+				if err != nil {
+					client.Close()
+					return
+				}
+				var up, down atomic.Int64
+				reason, _ := cfg.splice(client, backend, nil, &up, &down)
+				n, _ := reasons.LoadOrStore(reason, new(atomic.Int64))
+				n.(*atomic.Int64).Add(1)
+			}()
+		}
+	}()
+
+	var silent []net.Conn
+	for i := 0; i < conns; i++ {
+		c, err := net.Dial("tcp", proxyLn.Addr().String())
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		c.Write([]byte("hello"))
+		if i%2 == 0 {
+			// abandon abruptly
+			c.(*net.TCPConn).SetLinger(0)
+			c.Close()
+		} else {
+			// abandon silently: keep the socket open but never send again
+			silent = append(silent, c)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// give the accept loop time to pick up the last connections before waiting
+		time.Sleep(200 * time.Millisecond)
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("splices did not all return")
+	}
+	for _, c := range silent {
+		c.Close()
+	}
+
+	total := int64(0)
+	reasons.Range(func(k, v any) bool {
+		t.Logf("%s: %d", k, v.(*atomic.Int64).Load())
+		total += v.(*atomic.Int64).Load()
+		return true
+	})
+	if total != int64(conns) {
+		t.Fatalf("got %d finished splices, want %d", total, conns)
+	}
+
+	// Let the backend handlers observe their closes before counting.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		g, fds := runtime.NumGoroutine(), openFDs()
+		if g <= baseGoroutines+5 && (fds < 0 || fds <= baseFDs+5) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leak: goroutines %d (base %d), fds %d (base %d)", g, baseGoroutines, fds, baseFDs)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestSpliceHalfClose checks that a client half-closing its side still receives the backend's reply.
+func TestSpliceHalfClose(t *testing.T) {
+	cfg := spliceConfig{idleTimeout: 5 * time.Second}
+
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	go func() {
+		c, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		// read the whole request, then answer after the client has stopped sending
+		req, _ := io.ReadAll(c)
+		c.Write(append([]byte("re: "), req...))
+		c.Close()
+	}()
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+	result := make(chan string, 1)
+	go func() {
+		client, err := proxyLn.Accept()
+		if err != nil {
+			return
+		}
+		backend, err := net.Dial("tcp", backendLn.Addr().String())
+		if err != nil {
+			return
+		}
+		var up, down atomic.Int64
+		reason, _ := cfg.splice(client, backend, []byte(">"), &up, &down)
+		result <- reason
+	}()
+
+	c, err := net.Dial("tcp", proxyLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	c.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != ">re: ping" {
+		t.Fatalf("got %q", got)
+	}
+	if reason := <-result; reason != closeClientQuit {
+		t.Fatalf("reason %q, want %q", reason, closeClientQuit)
+	}
+}
+
+// openFDs counts this process's open file descriptors, or returns -1 where /proc isn't available.
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
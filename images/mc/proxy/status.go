@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status responses are built once and cached per listener and protocol version, framed and ready to
+// write, so answering a server list ping is a map lookup and a single write. Anything that changes what
+// a response says (draining, the backend going up, down or reporting other players, a wake starting or
+// finishing, quiet hours or the budget starting to refuse wakes) calls invalidateStatus. Only text that
+// changes by itself is refreshed on a timer: a wake's ETA every statusMaxAge, and the live player
+// sample's "2h ago" every minute.
+const statusMaxAge = time.Second
+
+// statusGen is bumped by invalidateStatus; cached responses from an older generation are rebuilt.
+var statusGen atomic.Uint64
+
+func invalidateStatus() { statusGen.Add(1) }
+
+// statusCache is one listener's cached status responses.
+type statusCache struct {
+	mu      sync.RWMutex
+	entries map[int32]*cachedStatus // protocol -> responses
+}
+
+// cachedStatus is a response for each of the favicons and PLAYER_SAMPLE orders the listener rotates
+// through (or just one).
+type cachedStatus struct {
+	frames  [][]byte
+	next    atomic.Uint32
+	gen     uint64
+	built   time.Time
+	refresh time.Duration // rebuilt this long after built even without an invalidation, if non-zero
+}
+
+// response returns l's framed status response for protocol, rebuilding it if it's stale. With several
+// favicons or a PLAYER_SAMPLE, each call returns the next response.
+func (c *statusCache) response(l *proxyListener, protocol int32) []byte {
+	gen := statusGen.Load()
+	c.mu.RLock()
+	e := c.entries[protocol]
+	c.mu.RUnlock()
+	if e == nil || e.gen != gen || e.refresh > 0 && time.Since(e.built) >= e.refresh {
+		e = &cachedStatus{refresh: statusRefresh(l), gen: gen, built: time.Now()}
+		e.frames = buildStatus(l, protocol)
+		c.mu.Lock()
+		// the protocol comes from the client, so don't let made-up ones grow the cache forever
+		if c.entries == nil || len(c.entries) >= 64 {
+			c.entries = map[int32]*cachedStatus{}
+		}
+		c.entries[protocol] = e
+		c.mu.Unlock()
+	}
+	if len(e.frames) == 1 {
+		return e.frames[0]
+	}
+	return e.frames[(e.next.Add(1)-1)%uint32(len(e.frames))]
+}
+
+// statusRefresh is how often l's responses need rebuilding for text that changes by itself, or zero if
+// invalidateStatus covers every change.
+func statusRefresh(l *proxyListener) time.Duration {
+	if !l.managed {
+		return 0
+	}
+	if inFlight, _, _ := wakes.progress(); inFlight {
+		return statusMaxAge
+	}
+	// the live sample's "ago" times, and sessions that end after the backend went down
+	if getEnv("PLAYER_SAMPLE_LIVE", "0") == "1" && !bedrockMode.Load() && !backend.isUp() {
+		return time.Minute
+	}
+	return 0
+}
+
+// statusSample is an entry in the player list shown when hovering the player count.
+type statusSample struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+// buildStatus renders l's status response for protocol as complete, length-prefixed packets, one per
+// favicon, and with PLAYER_SAMPLE that many again for each of playerSampleOrders shuffles of it. The
+// version echoes the client's protocol so the client doesn't mark the server as outdated.
+func buildStatus(l *proxyListener, protocol int32) [][]byte {
+	var statusObj struct {
+		Description struct {
+			Text string `json:"text"`
+		} `json:"description"`
+		Players statusPlayers `json:"players"`
+		Favicon string        `json:"favicon,omitempty"`
+		Version struct {
+			Name     string `json:"name"`
+			Protocol int32  `json:"protocol"`
+		} `json:"version"`
+	}
+	statusObj.Description.Text = l.description()
+	// Allow overriding player counts via environment variables
+	if v := getEnv("PLAYERS_MAX", ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			statusObj.Players.Max = n
+		} else {
+			slog.Warn("invalid PLAYERS_MAX", "value", v, "err", err)
+		}
+	}
+	if v := getEnv("PLAYERS_ONLINE", ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			statusObj.Players.Online = n
+		} else {
+			slog.Warn("invalid PLAYERS_ONLINE", "value", v, "err", err)
+		}
+	}
+	samples := [][]statusSample{nil}
+	if live := livePlayers(l); live != nil {
+		if live.Max > 0 {
+			statusObj.Players.Max, statusObj.Players.Online = live.Max, live.Online
+		}
+		samples[0] = live.Sample
+	} else if sample := playerSample(); len(sample) > 1 {
+		samples[0] = sample
+		for range playerSampleOrders - 1 {
+			samples = append(samples, playerSample())
+		}
+	} else {
+		samples[0] = sample
+	}
+	statusObj.Version.Name = fmt.Sprintf("proxy-%d", protocol)
+	statusObj.Version.Protocol = protocol
+
+	icons := l.favicons()
+	if len(icons) == 0 {
+		icons = []string{""}
+	}
+	frames := make([][]byte, 0, len(icons)*len(samples))
+	for _, sample := range samples {
+		statusObj.Players.Sample = sample
+		for _, icon := range icons {
+			statusObj.Favicon = icon
+			statusBytes, err := json.Marshal(statusObj)
+			if err != nil {
+				slog.Error("failed to marshal status JSON", "err", err)
+				continue
+			}
+			frames = append(frames, statusFrame(statusBytes))
+		}
+	}
+	if len(frames) == 0 {
+		// callers rotate through the frames, so there has to be one; a status without a favicon will do
+		statusObj.Favicon = ""
+		statusBytes, _ := json.Marshal(statusObj)
+		frames = append(frames, statusFrame(statusBytes))
+	}
+	return frames
+}
+
+// statusFrame frames status JSON as a length-prefixed Status Response packet.
+func statusFrame(statusBytes []byte) []byte {
+	packet := appendVarInt([]byte{0x00}, int32(len(statusBytes)))
+	packet = append(packet, statusBytes...)
+	return append(appendVarInt(make([]byte, 0, len(packet)+5), int32(len(packet))), packet...)
+}
+
+// statusPlayers is the players part of a status response.
+type statusPlayers struct {
+	Max    int            `json:"max"`
+	Online int            `json:"online"`
+	Sample []statusSample `json:"sample,omitempty"`
+}
+
+// livePlayers fills in the player list from real players when PLAYER_SAMPLE_LIVE=1: while the backend
+// is up, the counts and online players from its own status; while it sleeps, who was on last and when
+// ("Alice 2h ago"), from the session log, without counts (Max is zero). It returns nil to fall back to
+// PLAYER_SAMPLE, e.g. for listeners routing elsewhere. statusRefresh keeps the "ago" times current.
+func livePlayers(l *proxyListener) *statusPlayers {
+	if !l.managed || bedrockMode.Load() || getEnv("PLAYER_SAMPLE_LIVE", "0") != "1" {
+		return nil
+	}
+	if backend.isUp() {
+		var st struct {
+			Players statusPlayers `json:"players"`
+		}
+		if json.Unmarshal(backend.lastStatus(), &st) != nil {
+			return nil
+		}
+		return &st.Players
+	}
+	seen := sessions.lastSeen(getEnvInt("PLAYER_SAMPLE_SIZE", 5))
+	if len(seen) == 0 {
+		return nil
+	}
+	p := &statusPlayers{Sample: []statusSample{{Name: getEnv("PLAYER_SAMPLE_LIVE_HEADER", "§7Last online:"), ID: nilUUID}}}
+	for _, r := range seen {
+		id := r.UUID
+		if id == "" {
+			id = nilUUID
+		}
+		p.Sample = append(p.Sample, statusSample{Name: r.Username + " §7" + agoText(time.Since(r.End)), ID: id})
+	}
+	return p
+}
+
+// nilUUID stands in for the UUID of sample entries that aren't players.
+const nilUUID = "00000000-0000-0000-0000-000000000000"
+
+// agoText formats how long ago something was, e.g. "5m ago", "2h ago", "1d ago".
+func agoText(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
+
+// playerSampleOrders is how many shuffles of PLAYER_SAMPLE a status response is built with. Pings
+// rotate through them, so the list still changes from one refresh to the next between rebuilds.
+const playerSampleOrders = 8
+
+// playerSample renders PLAYER_SAMPLE (comma or pipe separated) as up to five sample entries in a random
+// order, which shows up in the client when hovering the player count. It can't replace the numeric
+// count. Each call shuffles it again.
+func playerSample() []statusSample {
+	sampleEnv := getEnv("PLAYER_SAMPLE", "")
+	if sampleEnv == "" {
+		return nil
+	}
+	sep := ","
+	if strings.Contains(sampleEnv, "|") {
+		sep = "|"
+	}
+	var entries []string
+	for _, p := range strings.Split(sampleEnv, sep) {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if len(p) > 32 {
+			p = p[:32]
+		}
+		entries = append(entries, p)
+	}
+	rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	var samples []statusSample
+	for _, name := range entries[:min(5, len(entries))] {
+		samples = append(samples, statusSample{Name: name, ID: nilUUID})
+	}
+	return samples
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/andreykaipov/infra/images/mc/proxy/internal/mctest"
+)
+
+// TestStatusResponseCached checks that answering a status ping from the cache doesn't allocate, and that
+// invalidating it picks up a change straight away.
+func TestStatusResponseCached(t *testing.T) {
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("MOTD", "cached")
+	l, err := setupReplay("", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := l.status.response(l, 767)
+	if allocs := testing.AllocsPerRun(1000, func() { l.status.response(l, 767) }); allocs != 0 {
+		t.Errorf("cached status response allocates %v times", allocs)
+	}
+	if other := l.status.response(l, 766); string(other) == string(first) {
+		t.Error("responses for different protocols are the same")
+	}
+
+	l.MOTD = "changed"
+	l.status.entries[767].built = time.Now().Add(-time.Hour) // no ETA, so age alone doesn't matter
+	if got := l.status.response(l, 767); string(got) != string(first) {
+		t.Error("response rebuilt without an invalidation")
+	}
+	invalidateStatus()
+	if got := l.status.response(l, 767); string(got) == string(first) {
+		t.Error("response not rebuilt after invalidateStatus")
+	}
+
+	// the backend reporting other players changes the live sample
+	rebuilt := l.status.entries[767]
+	backend.observe(time.Now(), []byte(`{"players":{"online":1}}`), nil)
+	l.status.response(l, 767)
+	if l.status.entries[767] == rebuilt {
+		t.Error("response not rebuilt after the backend's status changed")
+	}
+}
+
+// TestPlayerSampleRotates checks that PLAYER_SAMPLE's order changes from ping to ping without rebuilding
+// the response each time.
+func TestPlayerSampleRotates(t *testing.T) {
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("PLAYER_SAMPLE", "Alice,Bob,Carol,Dave,Erin,Frank")
+	l, err := setupReplay("", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for range playerSampleOrders {
+		seen[string(l.status.response(l, 767))] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("%d different responses in %d pings, want the sample reshuffled", len(seen), playerSampleOrders)
+	}
+	if e := l.status.entries[767]; len(e.frames) != playerSampleOrders {
+		t.Errorf("%d responses cached, want one per shuffle", len(e.frames))
+	}
+}
+
+func TestLivePlayerSample(t *testing.T) {
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("PLAYER_SAMPLE_LIVE", "1")
+	t.Setenv("PLAYER_SAMPLE", "Fake")
+	l, err := setupReplay("", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	sessions.recent = []sessionRecord{
+		{Username: "Alice", UUID: "a1", NextState: 2, BytesDown: 100, End: now.Add(-26 * time.Hour)},
+		{Username: "Bob", NextState: 2, BytesDown: 100, End: now.Add(-3 * time.Hour)},
+		{Username: "Mallory", NextState: 2, BytesDown: 0, End: now.Add(-time.Hour)}, // never got in
+		{Username: "alice", UUID: "a1", NextState: 2, BytesDown: 100, End: now.Add(-2 * time.Hour)},
+	}
+	p := livePlayers(l)
+	if p == nil || p.Max != 0 {
+		t.Fatalf("sleeping backend: got %+v, want a sample without counts", p)
+	}
+	want := []statusSample{{"§7Last online:", nilUUID}, {"alice §72h ago", "a1"}, {"Bob §73h ago", nilUUID}}
+	if !slices.Equal(p.Sample, want) {
+		t.Errorf("sleeping sample %q, want %q", p.Sample, want)
+	}
+
+	backend.observe(now, []byte(`{"players":{"max":20,"online":1,"sample":[{"name":"Carol","id":"c3"}]}}`), nil)
+	p = livePlayers(l)
+	if p == nil || p.Max != 20 || p.Online != 1 || !slices.Equal(p.Sample, []statusSample{{"Carol", "c3"}}) {
+		t.Errorf("online backend: got %+v, want the backend's players", p)
+	}
+}
+
+// BenchmarkStatusPing measures full server list exchanges (connect, handshake, status, ping-pong)
+// against a proxy over loopback. Run with -cpu 1 to see what one core handles.
+func BenchmarkStatusPing(b *testing.B) {
+	p := startProxy(b, mctest.Healthy)
+	for b.Loop() {
+		if _, _, err := p.client.Ping(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pings/s")
+}
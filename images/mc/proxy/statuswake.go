@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusWaker starts the backend when an allow-listed client pings the server list, so the server is
+// already booting by the time the player clicks Join. It is opt-in (WAKE_ON_STATUS=1) and rate limited
+// separately from login-triggered wakes.
+type statusWaker struct {
+	allow       []string
+	cooldown    time.Duration // minimum gap between any two status-triggered wakes
+	ipCooldown  time.Duration // minimum gap between status-triggered wakes from the same IP
+	maxPerHour  int
+	minProtocol int32
+
+	mu       sync.Mutex
+	last     time.Time
+	lastByIP map[string]time.Time
+	recent   []time.Time
+
+	resolved   map[string][]string // hostname -> addresses
+	resolvedAt map[string]time.Time
+}
+
+var statusWakes *statusWaker
+
+func newStatusWaker() *statusWaker {
+	if getEnv("WAKE_ON_STATUS", "0") != "1" {
+		return nil
+	}
+	s := &statusWaker{
+		allow:       splitList(getEnv("WAKE_ON_STATUS_ALLOW", "")),
+		cooldown:    time.Duration(getEnvInt("WAKE_ON_STATUS_COOLDOWN_S", 600)) * time.Second,
+		ipCooldown:  time.Duration(getEnvInt("WAKE_ON_STATUS_IP_COOLDOWN_S", 1800)) * time.Second,
+		maxPerHour:  getEnvInt("WAKE_ON_STATUS_MAX_PER_HOUR", 3),
+		minProtocol: int32(getEnvInt("WAKE_ON_STATUS_MIN_PROTOCOL", 47)),
+		lastByIP:    map[string]time.Time{},
+		resolved:    map[string][]string{},
+		resolvedAt:  map[string]time.Time{},
+	}
+	if len(s.allow) == 0 {
+		slog.Warn("WAKE_ON_STATUS=1 but WAKE_ON_STATUS_ALLOW is empty; status pings will never wake the backend")
+	}
+	slog.Info("wake on status enabled", "allow", s.allow, "cooldown", s.cooldown, "ip_cooldown", s.ipCooldown, "max_per_hour", s.maxPerHour)
+	return s
+}
+
+// onStatus is called after a client has completed a full status + ping exchange. Scanners typically
+// stop after the status response or send nonsense protocol versions, so only complete exchanges from
+// real client versions count.
+func (s *statusWaker) onStatus(ctx context.Context, remote net.Addr, protocol int32, l *proxyListener) {
+	if s == nil {
+		return
+	}
+	ip := remoteIP(remote)
+	if protocol < s.minProtocol || !s.allowed(ip) {
+		return
+	}
+	if inFlight, _, _ := wakes.progress(); inFlight {
+		return
+	}
+	// Only wake a backend that's actually asleep; otherwise the ARM call is wasted and the wake history
+	// would record a bogus near-zero boot time.
+	if _, err := probeBackend(l.Backend, time.Second); err == nil {
+		return
+	}
+	// A wake the listener's policies would refuse mustn't use up the rate limits, or the first ping after
+	// quiet hours end would find them spent.
+	if reason := wakeRefusal("", l.policy); reason != "" {
+		logger(ctx).Debug("wake on status refused", "reason", reason)
+		metrics.inc("mcproxy_wake_requests_total", "trigger", "status", "result", "refused")
+		return
+	}
+	if !s.take(ip) {
+		metrics.inc("mcproxy_wake_requests_total", "trigger", "status", "result", "rate_limited")
+		return
+	}
+	logger(ctx).Info("wake on status: pinged the server list; starting backend")
+	startAzureContainerApp(ctx, wakeEntry{Trigger: "status", IP: ip}, l.policy)
+}
+
+// take reserves a wake slot for ip if none of the status-wake rate limits are exceeded.
+func (s *statusWaker) take(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.last) < s.cooldown || now.Sub(s.lastByIP[ip]) < s.ipCooldown {
+		return false
+	}
+	kept := s.recent[:0]
+	for _, t := range s.recent {
+		if now.Sub(t) < time.Hour {
+			kept = append(kept, t)
+		}
+	}
+	s.recent = kept
+	if s.maxPerHour > 0 && len(s.recent) >= s.maxPerHour {
+		return false
+	}
+	s.last = now
+	s.lastByIP[ip] = now
+	s.recent = append(s.recent, now)
+	return true
+}
+
+// allowed reports whether ip matches an allow-list entry: a literal IP, a CIDR, or a hostname (e.g. a
+// friend's dynamic DNS name) that currently resolves to ip.
+func (s *statusWaker) allowed(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range s.allow {
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if cidr.Contains(addr) {
+				return true
+			}
+			continue
+		}
+		if literal := net.ParseIP(entry); literal != nil {
+			if literal.Equal(addr) {
+				return true
+			}
+			continue
+		}
+		for _, a := range s.resolve(entry) {
+			if net.ParseIP(a).Equal(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolve looks up host, caching results for a few minutes so a burst of pings doesn't hammer DNS.
+func (s *statusWaker) resolve(host string) []string {
+	s.mu.Lock()
+	if time.Since(s.resolvedAt[host]) < 5*time.Minute {
+		addrs := s.resolved[host]
+		s.mu.Unlock()
+		return addrs
+	}
+	s.mu.Unlock()
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		slog.Warn("wake on status: failed to resolve", "host", host, "err", err)
+	}
+	s.mu.Lock()
+	s.resolved[host] = addrs
+	s.resolvedAt[host] = time.Now()
+	s.mu.Unlock()
+	return addrs
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// splitList splits a comma separated env value, dropping blanks.
+func splitList(v string) []string {
+	var out []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andreykaipov/infra/images/mc/proxy/internal/mctest"
+)
+
+func TestStatusWakeRefusalKeepsRateLimits(t *testing.T) {
+	arm := mctest.NewARM("e2e-token")
+	t.Cleanup(arm.Close)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	// a window two days from now, so wakes are refused today
+	day := time.Now().UTC().AddDate(0, 0, 2).Weekday().String()[:3]
+	t.Setenv("WAKE_WINDOWS", day+" 10:00-11:00")
+	t.Setenv("SCHEDULE_TZ", "UTC")
+	t.Setenv("WAKE_ON_STATUS", "1")
+	t.Setenv("WAKE_ON_STATUS_ALLOW", "127.0.0.1")
+	t.Setenv("WAKE_READY_TIMEOUT_S", "1")
+	t.Setenv("WAKE_POLL_MS", "100")
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "sub")
+	t.Setenv("AZURE_RESOURCE_GROUP", "rg")
+	t.Setenv("AZURE_CONTAINER_APP_NAME", "mc")
+	t.Setenv("AZURE_ARM_ENDPOINT", arm.URL())
+	t.Setenv("AZURE_ARM_TOKEN", "e2e-token")
+	l, err := setupReplay("", down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { waitWakes(t) })
+	startMu.Lock()
+	lastStartTime, starting = time.Time{}, false
+	startMu.Unlock()
+
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	statusWakes.onStatus(context.Background(), remote, 767, l)
+	if starts := arm.Starts(); len(starts) != 0 {
+		t.Fatalf("ARM start requests %v during quiet hours", starts)
+	}
+	statusWakes.mu.Lock()
+	used := len(statusWakes.recent)
+	statusWakes.mu.Unlock()
+	if used != 0 {
+		t.Errorf("%d status wakes counted against the hourly limit for a refused wake", used)
+	}
+
+	// once quiet hours are over, the same client can wake the backend straight away
+	quietHours = nil
+	statusWakes.onStatus(context.Background(), remote, 767, l)
+	if starts := arm.Starts(); len(starts) != 1 {
+		t.Errorf("ARM start requests %v after quiet hours, want one", starts)
+	}
+	closed := func() bool {
+		budget.mu.Lock()
+		defer budget.mu.Unlock()
+		n := len(budget.state.Periods)
+		return n > 0 && !budget.state.Periods[n-1].End.IsZero()
+	}
+	for deadline := time.Now().Add(5 * time.Second); !closed(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("wake still running after it timed out")
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/andreykaipov/infra/images/mc/proxy")
+
+// setupTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT (or the traces-specific
+// variant) is set; the exporter reads the rest of the standard OTEL_* variables itself. Without an
+// endpoint spans are no-ops. The returned function flushes pending spans.
+func setupTracing(ctx context.Context) func(context.Context) error {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }
+	}
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		slog.Error("tracing disabled: failed to create OTLP exporter", "err", err)
+		return func(context.Context) error { return nil }
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "mc-proxy")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		slog.Warn("tracing: incomplete resource", "err", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	slog.Info("tracing enabled")
+	return tp.Shutdown
+}
+
+// startSpan starts a span under whatever ctx carries. When it begins a new trace, the trace ID is
+// added to ctx's logger so every later log line for this work can be matched to the trace.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	isRoot := !trace.SpanContextFromContext(ctx).IsValid()
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	if sc := span.SpanContext(); isRoot && sc.IsValid() {
+		ctx = withLogger(ctx, logger(ctx).With("trace_id", sc.TraceID().String()))
+	}
+	return ctx, span
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// wakeRecord is one completed wake: when the start was requested and how long the backend took to answer
+// a status ping afterwards.
+type wakeRecord struct {
+	Started    time.Time `json:"started"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// wakeTracker remembers when the current backend wake began and how long previous wakes took, so status
+// pings and disconnects can tell players roughly when the server will be ready.
+type wakeTracker struct {
+	backendAddr  string
+	path         string
+	keep         int
+	defaultETA   time.Duration
+	pollInterval time.Duration
+	readyTimeout time.Duration
+
+	mu        sync.Mutex
+	startedAt time.Time // zero when no wake is in flight
+	history   []wakeRecord
+}
+
+var wakes *wakeTracker
+
+func newWakeTracker(backendAddr string) *wakeTracker {
+	w := &wakeTracker{
+		backendAddr:  backendAddr,
+		path:         statePath("WAKE_HISTORY_PATH", "wake-history.json"),
+		keep:         getEnvInt("WAKE_HISTORY_SIZE", 20),
+		defaultETA:   time.Duration(getEnvInt("WAKE_ETA_DEFAULT_S", 90)) * time.Second,
+		pollInterval: time.Duration(getEnvInt("WAKE_POLL_MS", 2000)) * time.Millisecond,
+		readyTimeout: time.Duration(getEnvInt("WAKE_READY_TIMEOUT_S", 600)) * time.Second,
+	}
+	if err := loadJSONFile(w.path, &w.history); err != nil {
+		slog.Error("wake history: failed to load", "path", w.path, "err", err)
+	}
+	slog.Info("wake history loaded", "wakes", len(w.history), "estimate", w.estimate())
+	return w
+}
+
+// begin marks a wake as started at requested and watches the backend until it answers a status ping.
+// Calling begin while a wake is already in flight keeps the original start time.
+func (w *wakeTracker) begin(ctx context.Context, requested time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.startedAt.IsZero() {
+		return
+	}
+	w.startedAt = requested
+	invalidateStatus()
+	go w.watchReady(ctx, requested)
+}
+
+// watchReady polls the backend until it answers a status ping. The span records an event each time
+// the kind of failure changes, which separates waiting for the container to be scheduled (dials
+// refused or timing out) from waiting for the server itself to boot (port open, no status yet).
+func (w *wakeTracker) watchReady(ctx context.Context, started time.Time) {
+	ctx, span := startSpan(ctx, "backend.ready", attribute.String("server.address", w.backendAddr))
+	defer span.End()
+	phase := ""
+	for time.Since(started) < w.readyTimeout {
+		_, err := probeBackend(w.backendAddr, w.pollInterval)
+		if err == nil {
+			span.AddEvent("ready")
+			w.finish(ctx, started, time.Since(started))
+			return
+		}
+		p := "booting"
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Op == "dial" {
+			p = "unreachable"
+		}
+		if p != phase {
+			phase = p
+			span.AddEvent(p, trace.WithAttributes(attribute.String("error", err.Error())))
+		}
+		time.Sleep(w.pollInterval)
+	}
+	span.SetStatus(codes.Error, "backend not ready in time")
+	logger(ctx).Warn("wake: backend not ready in time; giving up on this wake", "timeout", w.readyTimeout)
+	w.mu.Lock()
+	w.startedAt = time.Time{}
+	w.mu.Unlock()
+	invalidateStatus()
+	// The container is running (and billed) but not serving, and the watcher never saw it come up so
+	// won't report it stopping. Stop it, and only then close the runtime period; if the stop fails, the
+	// period stays open, counting too much rather than too little, until the watcher sees the backend
+	// come up and go down again.
+	if err := stopAzureContainerApp(ctx); err != nil {
+		logger(ctx).Error("wake: failed to stop the backend that never became ready", "err", err)
+		return
+	}
+	logger(ctx).Info("wake: stopped the backend that never became ready")
+	budget.onStop(time.Now())
+}
+
+func (w *wakeTracker) finish(ctx context.Context, started time.Time, took time.Duration) {
+	w.mu.Lock()
+	w.startedAt = time.Time{}
+	w.history = append(w.history, wakeRecord{Started: started, DurationMs: took.Milliseconds()})
+	if len(w.history) > w.keep {
+		w.history = w.history[len(w.history)-w.keep:]
+	}
+	history := append([]wakeRecord(nil), w.history...)
+	w.mu.Unlock()
+	invalidateStatus()
+
+	logger(ctx).Info("wake: backend ready", "took", took.Round(time.Second))
+	notify.send("ready", "took", roughDuration(took))
+	go backend.probe()
+	if err := saveJSONFile(w.path, history); err != nil {
+		slog.Error("wake history: failed to save", "path", w.path, "err", err)
+	}
+}
+
+// estimate returns the median duration of recorded wakes, or the configured default with no history.
+// Callers hold w.mu.
+func (w *wakeTracker) estimate() time.Duration {
+	if len(w.history) == 0 {
+		return w.defaultETA
+	}
+	ds := make([]int64, len(w.history))
+	for i, r := range w.history {
+		ds[i] = r.DurationMs
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return time.Duration(ds[len(ds)/2]) * time.Millisecond
+}
+
+// progress reports whether a wake is in flight and, if so, how long ago it began and how much longer
+// it is expected to take.
+func (w *wakeTracker) progress() (inFlight bool, elapsed, remaining time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.startedAt.IsZero() {
+		return false, 0, 0
+	}
+	elapsed = time.Since(w.startedAt)
+	return true, elapsed, w.estimate() - elapsed
+}
+
+// etaText renders the remaining time as "ready in ~70s", or "almost ready" once the estimate is used up.
+// With no wake in flight it assumes one is about to start and reports the full estimate.
+func (w *wakeTracker) etaText() string {
+	inFlight, _, remaining := w.progress()
+	if !inFlight {
+		w.mu.Lock()
+		remaining = w.estimate()
+		w.mu.Unlock()
+	}
+	if remaining <= 0 {
+		return "almost ready"
+	}
+	return "ready in ~" + roughDuration(remaining)
+}
+
+// wakeMOTD renders WAKE_MOTD for an in-flight wake. {eta} and {elapsed} are substituted.
+func (w *wakeTracker) wakeMOTD() string {
+	_, elapsed, _ := w.progress()
+	tmpl := getEnv("WAKE_MOTD", "§eServer is starting up, {eta} §7({elapsed} so far)")
+	return fmtTemplate(tmpl, "eta", w.etaText(), "elapsed", roughDuration(elapsed))
+}
+
+// policySet selects which wake policies apply, so e.g. an operators' listener can skip them.
+type policySet struct{ quietHours, budget, quota bool }
+
+// allPolicies applies to scheduled wakes and to listeners that don't list their policies.
+var allPolicies = policySet{quietHours: true, budget: true, quota: true}
+
+// wakeRefusal returns a player-facing reason when policy forbids waking the backend right now, or ""
+// when a wake may proceed. player is empty for wakes not caused by a login.
+func wakeRefusal(player string, p policySet) string {
+	now := time.Now()
+	if p.quietHours && !quietHours.allowed(now) {
+		return quietHours.refusal(now)
+	}
+	if p.budget && budget != nil && budget.exceeded(now) {
+		return budget.refusal()
+	}
+	if p.quota && ledger != nil {
+		return ledger.refusal(player, now)
+	}
+	return ""
+}
+
+// roughDuration formats d as "70s" (to the nearest 5s) below 100 seconds and as whole minutes above.
+func roughDuration(d time.Duration) string {
+	s := d.Seconds()
+	if s < 100 {
+		return fmt.Sprintf("%ds", int(math.Round(s/5)*5))
+	}
+	return fmt.Sprintf("%dm", int(math.Round(s/60)))
+}
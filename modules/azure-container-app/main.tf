@@ -98,6 +98,30 @@ resource "azurerm_container_app" "app" {
           }
         }
 
+        dynamic "liveness_probe" {
+          for_each = container.value.health != null ? [container.value.health] : []
+          content {
+            transport               = "HTTP"
+            port                    = liveness_probe.value.port
+            path                    = liveness_probe.value.liveness_path
+            initial_delay           = liveness_probe.value.initial_delay
+            interval_seconds        = liveness_probe.value.interval_seconds
+            failure_count_threshold = liveness_probe.value.failure_count_threshold
+          }
+        }
+
+        dynamic "readiness_probe" {
+          for_each = container.value.health != null && try(container.value.health.readiness, false) ? [container.value.health] : []
+          content {
+            transport               = "HTTP"
+            port                    = readiness_probe.value.port
+            path                    = readiness_probe.value.readiness_path
+            initial_delay           = readiness_probe.value.initial_delay
+            interval_seconds        = readiness_probe.value.interval_seconds
+            failure_count_threshold = readiness_probe.value.failure_count_threshold
+          }
+        }
+
         volume_mounts {
           name = "shared"
           path = "/shared"
@@ -77,6 +77,16 @@ variable "containers" {
     cpu    = optional(number, 0.25)
     memory = optional(string, "0.5Gi")
     env    = optional(map(string), {})
+    # HTTP liveness/readiness probes against a side port serving /healthz and /readyz
+    health = optional(object({
+      port                    = number
+      liveness_path           = optional(string, "/healthz")
+      readiness_path          = optional(string, "/readyz")
+      readiness               = optional(bool, true) # a failing readiness probe takes the whole replica out of ingress
+      initial_delay           = optional(number, 5)
+      interval_seconds        = optional(number, 10)
+      failure_count_threshold = optional(number, 3)
+    }))
   }))
   description = "List of containers to run in the pod"
   sensitive   = true
@@ -64,8 +64,12 @@ inputs = {
       sha    = ""
       cpu    = 0.25
       memory = "0.5Gi"
+      health = {
+        port = 8081
+      }
       env = {
         LISTEN_ADDR    = ":25565"
+        HEALTH_ADDR    = ":8081"
         BACKEND_ADDR   = "minecraft-java:25566"
         PLAYERS_ONLINE = 420
         PLAYERS_MAX    = 69
@@ -145,7 +145,13 @@ EOF
       sha    = ""
       cpu    = 0.25
       memory = "0.5Gi"
+      health = {
+        port = 8082
+        # RCON is down while the server boots; don't let that hold the server back from ingress
+        readiness = false
+      }
       env = {
+        HEALTH_ADDR              = ":8082"
         MINECRAFT_HOST           = "localhost"
         RCON_PORT                = "25575"
         RCON_PASSWORD            = local.secrets.minecraft.rcon_password